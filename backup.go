@@ -0,0 +1,1028 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// snapshot is a point-in-time cut of the files of a store. It holds its own
+// handles on them, so a merge removing a file does not affect it.
+type snapshot struct {
+	d *Daklak
+	// lsn is the LSN of the latest record in the snapshot.
+	lsn      uint64
+	segments []snapshotFile
+	hints    []snapshotFile
+	vlogs    map[uint32]snapshotFile
+	// meta are the other files of the store, copied as they are.
+	meta []snapshotFile
+}
+
+type snapshotFile struct {
+	path string
+	f    *os.File
+	size int64
+	// id, start and format are those of the segment or value log.
+	id     uint32
+	start  int64
+	format record.Format
+}
+
+// manifest lists the files of a backup. A full backup holds the store up to
+// LSN to, an incremental one the records after from up to to.
+type manifest struct {
+	version     int
+	incremental bool
+	from, to    uint64
+	files       map[string]manifestEntry
+}
+
+// manifestEntry is a file of a backup as listed in its manifest.
+type manifestEntry struct {
+	sum  string
+	size int64
+}
+
+// Backup writes a consistent copy of the store to w as a tar stream while
+// reads and writes continue, and returns the LSN it reaches. The stream ends
+// with a manifest holding the SHA-256 of every file, which Restore checks.
+// The backup becomes the one incremental backups follow, unless the store is
+// read-only: the cut of another process is not known to the writer.
+func (d *Daklak) Backup(w io.Writer) (uint64, error) {
+	snap, err := d.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.close()
+
+	tw := tar.NewWriter(w)
+	err = writeBackup(tarCreate(tw, d.opts.FileMode), &manifest{to: snap.lsn}, snap.files())
+	if err == nil {
+		err = tw.Close()
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	d.recordBackup(snap.lsn)
+	return snap.lsn, nil
+}
+
+// BackupTo writes a consistent copy of the store to dir, which must not exist
+// or be empty, while reads and writes continue, and returns the LSN it
+// reaches. dir is a usable store as is; it also holds a manifest with the
+// SHA-256 of every file, which Restore checks. It is recorded like Backup.
+func (d *Daklak) BackupTo(dir string) (uint64, error) {
+	if err := makeEmptyDir(dir, d.opts.FileMode); err != nil {
+		return 0, err
+	}
+
+	snap, err := d.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.close()
+
+	err = writeBackup(dirCreate(dir, d.opts.FileMode), &manifest{to: snap.lsn}, snap.files())
+	if err == nil {
+		// Incremental backups can be restored on top of dir.
+		err = writeBackupLSN(dir, snap.lsn, d.opts.FileMode)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	d.recordBackup(snap.lsn)
+	return snap.lsn, nil
+}
+
+// BackupSince writes the records appended after lsn to w as a tar stream
+// while reads and writes continue, and returns the LSN it reaches. lsn is
+// the one returned by the latest backup, full or incremental, and Restore
+// applies the stream on top of the store restored from that backup. An older
+// lsn fails with ErrLSNTooOld since merges only keep the deletes newer than
+// the latest backup, and only with Options.IncrementalBackups.
+func (d *Daklak) BackupSince(w io.Writer, lsn uint64) (uint64, error) {
+	snap, err := d.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.close()
+
+	// Read after the snapshot is taken: a merge moves it before removing the
+	// segments the snapshot may hold.
+	latest, ok, err := readBackupLSN(d.path)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok || lsn < latest {
+		return 0, fmt.Errorf("%w: %d is older than the latest backup", ErrLSNTooOld, lsn)
+	}
+
+	if lsn > snap.lsn {
+		return 0, fmt.Errorf("LSN %d is past the latest record at %d", lsn, snap.lsn)
+	}
+
+	changes, err := os.CreateTemp("", "daklak-changes-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(changes.Name())
+	defer changes.Close()
+
+	if err = snap.writeChanges(changes, lsn); err != nil {
+		return 0, err
+	}
+
+	size, err := changes.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		tw    = tar.NewWriter(w)
+		m     = &manifest{incremental: true, from: lsn, to: snap.lsn}
+		files = []snapshotFile{{path: changesFile, f: changes, size: size}}
+	)
+	err = writeBackup(tarCreate(tw, d.opts.FileMode), m, files)
+	if err == nil {
+		err = tw.Close()
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	d.recordBackup(snap.lsn)
+	return snap.lsn, nil
+}
+
+// LSN returns the LSN of the latest record. Every Set, SetEx, Delete and
+// expiry change gets the next one.
+func (d *Daklak) LSN() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.lsn
+}
+
+// recordBackup makes lsn the LSN of the latest backup, the one incremental
+// backups follow. Backups of a read-only store are not recorded.
+func (d *Daklak) recordBackup(lsn uint64) {
+	if d.opts.ReadOnly {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	latest, ok, err := readBackupLSN(d.path)
+	if err == nil && (!ok || lsn > latest) {
+		err = writeBackupLSN(d.path, lsn, d.opts.FileMode)
+	}
+
+	if err != nil {
+		d.logf("daklak: record backup LSN %d: %v", lsn, err)
+	}
+}
+
+// advanceBackupLSN moves the LSN of the latest backup up to lsn, after a merge
+// dropped the deletes and expired records after it. Without a backup there is
+// nothing to move.
+func (d *Daklak) advanceBackupLSN(lsn uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	latest, ok, err := readBackupLSN(d.path)
+	if err != nil || !ok || lsn <= latest {
+		return err
+	}
+
+	return writeBackupLSN(d.path, lsn, d.opts.FileMode)
+}
+
+// retainedSince returns the LSN after which merges keep deletes and expired
+// records, math.MaxUint64 when they keep none. Backups in progress are left
+// to the caller.
+func (d *Daklak) retainedSince() (uint64, error) {
+	if !d.opts.IncrementalBackups {
+		return math.MaxUint64, nil
+	}
+
+	lsn, ok, err := readBackupLSN(d.path)
+	if err != nil || !ok {
+		// Without a backup there is nothing to be incremental to.
+		return math.MaxUint64, err
+	}
+
+	return lsn, nil
+}
+
+// readBackupLSN reads the LSN of the latest backup of the store in dir, or of
+// the backup the store in dir was restored from. A merge that drops records
+// after it moves it up.
+func readBackupLSN(dir string) (uint64, bool, error) {
+	return readNumber(filepath.Join(dir, backupLSNFile))
+}
+
+func writeBackupLSN(dir string, lsn uint64, mode os.FileMode) error {
+	return writeNumber(filepath.Join(dir, backupLSNFile), lsn, mode)
+}
+
+// readNumber reads the number kept in the file at path and reports whether
+// the file exists.
+func readNumber(path string) (uint64, bool, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, false, &CorruptionError{Path: path, Err: err}
+	}
+
+	return n, true, nil
+}
+
+// writeNumber replaces the file at path with one holding n.
+func writeNumber(path string, n uint64, mode os.FileMode) error {
+	if err := os.WriteFile(path+tmpExt, []byte(strconv.FormatUint(n, 10)+"\n"), mode); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path + tmpExt)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(path+tmpExt, path)
+	}
+
+	if err != nil {
+		_ = os.Remove(path + tmpExt)
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// snapshot cuts the store between two writes: every segment, hint file and
+// value log up to its size at that point. Merges keep the deletes after the
+// cut until the snapshot is closed.
+func (d *Daklak) snapshot() (*snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.vlogMu.Lock()
+	defer d.vlogMu.Unlock()
+	d.segMu.RLock()
+	defer d.segMu.RUnlock()
+
+	snap := &snapshot{d: d, lsn: d.lsn, vlogs: make(map[uint32]snapshotFile)}
+	open := func(path string, size int64) (snapshotFile, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return snapshotFile{}, err
+		}
+
+		if size < 0 {
+			info, err := f.Stat()
+			if err != nil {
+				_ = f.Close()
+				return snapshotFile{}, err
+			}
+
+			size = info.Size()
+		}
+
+		return snapshotFile{path: path, f: f, size: size}, nil
+	}
+
+	ids := make([]uint32, 0, len(d.segments))
+	for id := range d.segments {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		seg := d.segments[id]
+		file, err := open(seg.path, seg.size)
+		if err != nil {
+			snap.closeFiles()
+			return nil, err
+		}
+
+		file.id, file.start, file.format = seg.id, seg.start, seg.format()
+		snap.segments = append(snap.segments, file)
+
+		// A hint file covers a prefix of its segment, it is replaced rather
+		// than changed in place.
+		file, err = open(filepath.Join(d.path, hintName(seg.id)), -1)
+		if err == nil {
+			snap.hints = append(snap.hints, file)
+		} else if !os.IsNotExist(err) {
+			snap.closeFiles()
+			return nil, err
+		}
+	}
+
+	for _, vl := range d.vlogs {
+		file, err := open(vl.path, vl.size)
+		if err != nil {
+			snap.closeFiles()
+			return nil, err
+		}
+
+		file.id, file.start, file.format = vl.id, vl.start, vl.format()
+		snap.vlogs[vl.id] = file
+	}
+
+	// The next value log id goes with the value logs, records in the
+	// segments may point into collected ones.
+	file, err := open(filepath.Join(d.path, valueLogIDFile), -1)
+	if err == nil {
+		snap.meta = append(snap.meta, file)
+	} else if !os.IsNotExist(err) {
+		snap.closeFiles()
+		return nil, err
+	}
+
+	if d.cuts == nil {
+		d.cuts = make(map[uint64]int)
+	}
+
+	d.cuts[snap.lsn]++
+	return snap, nil
+}
+
+// files returns every file of the snapshot by name.
+func (s *snapshot) files() []snapshotFile {
+	files := append(append(append([]snapshotFile(nil), s.segments...), s.hints...), s.meta...)
+	for _, file := range s.vlogs {
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files
+}
+
+// writeChanges writes the records of the snapshot after LSN since to w as a
+// segment. Values in value logs are written inline, and batches only once
+// committed.
+func (s *snapshot) writeChanges(w io.Writer, since uint64) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(newSegmentHeader().marshal()); err != nil {
+		return err
+	}
+
+	// A value log is only removed once no live key points into it, so a
+	// record pointing into one the snapshot does not have, or to a later
+	// value, was overridden or has expired and its value is not needed.
+	emit := func(r *record.Record) ([]byte, error) {
+		if r.Pointer != nil {
+			r.Value = nil
+			if _, ok := s.vlogs[r.Pointer.File]; ok {
+				value, err := s.readValue(r.Key, r.LSN, *r.Pointer)
+				if err != nil && !errors.Is(err, record.ErrInvalidPointer) {
+					return nil, err
+				}
+
+				r.Value = value
+			}
+
+			r.Pointer = nil
+		}
+
+		b, err := r.MarshalWith(s.d.opts.Compression, s.d.opts.KeyProvider)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = bw.Write(b)
+		return b, err
+	}
+
+	var (
+		batch []*record.Record
+		raw   [][]byte
+	)
+	err := s.scan(func(seg snapshotFile, r *record.Record, b []byte, offset int64) error {
+		if offset == seg.start {
+			batch, raw = nil, nil
+		}
+
+		switch {
+		case r.Batch:
+			batch, raw = append(batch, r), append(raw, b)
+			return nil
+		case r.Header.Type == record.TypeBatchCommit:
+			// A batch is stamped as a whole, its commit record gets the LSN
+			// of its last record.
+			records := batch[len(batch)-committed(raw, r):]
+			batch, raw = nil, nil
+			if len(records) == 0 || r.LSN <= since {
+				return nil
+			}
+
+			checksum := uint32(0)
+			for _, rec := range records {
+				b, err := emit(rec)
+				if err != nil {
+					return err
+				}
+
+				checksum = crc32.Update(checksum, crcTable, b)
+			}
+
+			commit := record.NewBatchCommit(uint32(len(records)), checksum)
+			commit.LSN, commit.WrittenAt = r.LSN, r.WrittenAt
+			_, err := emit(commit)
+			return err
+		}
+
+		batch, raw = nil, nil
+		if r.LSN <= since {
+			return nil
+		}
+
+		_, err := emit(r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// scan calls fn with every record of the segments of the snapshot, in
+// order. Like opening the store, it stops reading a segment at a record it
+// cannot read.
+func (s *snapshot) scan(fn func(seg snapshotFile, r *record.Record, raw []byte, offset int64) error) error {
+	for _, seg := range s.segments {
+		var fnErr error
+		err := scanRecords(seg.f, seg.path, seg.format, s.d.opts.KeyProvider, seg.start, seg.size, func(r *record.Record, raw []byte, offset int64) error {
+			fnErr = fn(seg, r, raw, offset)
+			return fnErr
+		})
+
+		var corruption *CorruptionError
+		if fnErr != nil || (err != nil && !errors.As(err, &corruption)) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readValue reads the value of key at p from the value logs of the snapshot
+// for the record with the given LSN.
+func (s *snapshot) readValue(key string, lsn uint64, p record.ValuePointer) ([]byte, error) {
+	file, ok := s.vlogs[p.File]
+	if !ok {
+		return nil, &CorruptionError{Path: filepath.Join(s.d.path, valueLogName(p.File)), Offset: p.Offset, Err: os.ErrNotExist}
+	}
+
+	b := make([]byte, p.Size)
+	if _, err := file.f.ReadAt(b, p.Offset); err != nil {
+		return nil, err
+	}
+
+	return s.d.decodeValue(b, file.path, file.format, key, lsn, p)
+}
+
+func (s *snapshot) close() {
+	s.closeFiles()
+
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if s.d.cuts[s.lsn]--; s.d.cuts[s.lsn] == 0 {
+		delete(s.d.cuts, s.lsn)
+	}
+}
+
+func (s *snapshot) closeFiles() {
+	for _, file := range s.files() {
+		_ = file.f.Close()
+	}
+}
+
+// writeBackup copies files to the writers create returns for them, followed
+// by the manifest of the copy.
+func writeBackup(create func(name string, size int64) (io.WriteCloser, error), m *manifest, files []snapshotFile) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %d\n", backupMagic, backupVersion)
+	if m.incremental {
+		fmt.Fprintf(&b, "incremental %d %d\n", m.from, m.to)
+	} else {
+		fmt.Fprintf(&b, "full %d\n", m.to)
+	}
+
+	copyFile := func(name string, size int64, src io.Reader) (string, error) {
+		w, err := create(name, size)
+		if err != nil {
+			return "", err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(w, h), src)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+
+		return hex.EncodeToString(h.Sum(nil)), err
+	}
+
+	for _, file := range files {
+		name := filepath.Base(file.path)
+		sum, err := copyFile(name, file.size, io.NewSectionReader(file.f, 0, file.size))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&b, "%s %d %s\n", sum, file.size, name)
+	}
+
+	_, err := copyFile(manifestFile, int64(b.Len()), &b)
+	return err
+}
+
+// tarCreate returns a create function for writeBackup adding files to tw.
+func tarCreate(tw *tar.Writer, mode os.FileMode) func(name string, size int64) (io.WriteCloser, error) {
+	now := time.Now()
+	return func(name string, size int64) (io.WriteCloser, error) {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     int64(mode),
+			Size:     size,
+			ModTime:  now,
+		})
+		return nopCloser{tw}, err
+	}
+}
+
+// dirCreate returns a create function for writeBackup creating files in dir.
+func dirCreate(dir string, mode os.FileMode) func(name string, size int64) (io.WriteCloser, error) {
+	return func(name string, _ int64) (io.WriteCloser, error) {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		return syncCloser{f}, err
+	}
+}
+
+// Restore rebuilds a store in dir from a backup at src: either a tar stream
+// written by Backup, BackupSince or a directory written by BackupTo. A full
+// backup needs dir not to exist or be empty. An incremental backup is
+// applied on top of the store restored in dir from the backup it follows,
+// so a full backup and the chain of incremental ones after it are restored
+// in order; dir must not be written to in between. Every file is checked
+// against the manifest of the backup; none of its files are left in dir
+// when the backup does not match it.
+func Restore(src, dir string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	empty, err := prepareDir(dir, defaultFileMode)
+	if err != nil {
+		return err
+	}
+
+	// Nothing may open the store before it is complete.
+	lock, err := lockFiles(dir, defaultFileMode, true, lockFile, readLockFile)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	var lsn uint64
+	if !empty {
+		// Only a store restored from a backup takes incremental ones.
+		var ok bool
+		if lsn, ok, err = readBackupLSN(dir); err != nil {
+			return err
+		}
+
+		if !ok {
+			return fmt.Errorf("%s is not empty", dir)
+		}
+	}
+
+	r := &restorer{dir: dir, files: make(map[string]manifestEntry)}
+	if info.IsDir() {
+		err = r.readDir(src)
+	} else {
+		err = r.readTar(src)
+	}
+
+	if err == nil {
+		err = r.check(empty, lsn)
+	}
+
+	if err == nil {
+		err = r.commit()
+	}
+
+	if err != nil {
+		r.abort()
+		return err
+	}
+
+	return nil
+}
+
+// restorer writes the files of a backup to dir under temporary names until
+// they are checked against the manifest.
+type restorer struct {
+	dir      string
+	files    map[string]manifestEntry
+	manifest *manifest
+	// done holds the files given their final name.
+	done []string
+}
+
+func (r *restorer) readDir(src string) error {
+	b, err := os.ReadFile(filepath.Join(src, manifestFile))
+	if err != nil {
+		return err
+	}
+
+	if r.manifest, err = parseManifest(b); err != nil {
+		return err
+	}
+
+	for name := range r.manifest.files {
+		if err = r.restoreFile(name, filepath.Join(src, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+func (r *restorer) restoreFile(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return r.add(name, f, info.Mode().Perm())
+}
+
+func (r *restorer) readTar(src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(bufio.NewReader(f))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, hdr.Name)
+		}
+
+		if hdr.Name == manifestFile {
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+
+			if r.manifest, err = parseManifest(b); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err = r.add(hdr.Name, tr, hdr.FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if r.manifest == nil {
+		return fmt.Errorf("%w: no %s", ErrInvalidBackup, manifestFile)
+	}
+
+	return nil
+}
+
+// add writes the file name of the backup from src.
+func (r *restorer) add(name string, src io.Reader, mode os.FileMode) error {
+	if !validBackupName(name) {
+		return fmt.Errorf("%w: invalid file name %q", ErrInvalidBackup, name)
+	}
+
+	if _, ok := r.files[name]; ok {
+		return fmt.Errorf("%w: %s appears twice", ErrInvalidBackup, name)
+	}
+
+	f, err := os.OpenFile(filepath.Join(r.dir, name+tmpExt), os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	// Recorded first so abort removes it whatever happens next.
+	r.files[name] = manifestEntry{}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), src)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	r.files[name] = manifestEntry{sum: hex.EncodeToString(h.Sum(nil)), size: size}
+	return err
+}
+
+// check matches the backup against dir: a full backup goes to an empty
+// directory, an incremental one on top of the backup it follows.
+func (r *restorer) check(empty bool, lsn uint64) error {
+	m := r.manifest
+	switch {
+	case empty && m.incremental:
+		return fmt.Errorf("%w: the backup is incremental, the one it follows must be restored first", ErrInvalidBackup)
+	case !empty && !m.incremental:
+		return fmt.Errorf("%s is not empty", r.dir)
+	case !empty && m.from != lsn:
+		return fmt.Errorf("%w: the backup follows LSN %d, %s is at %d", ErrInvalidBackup, m.from, r.dir, lsn)
+	}
+
+	if m.incremental {
+		for name := range m.files {
+			if name != changesFile {
+				return fmt.Errorf("%w: unexpected file %s in an incremental backup", ErrInvalidBackup, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// commit checks the files against the manifest and gives them their names.
+// The records of an incremental backup become the next segment of dir.
+func (r *restorer) commit() error {
+	for name, want := range r.manifest.files {
+		got, ok := r.files[name]
+		if !ok {
+			return fmt.Errorf("%w: %s is missing", ErrInvalidBackup, name)
+		}
+
+		if got != want {
+			return fmt.Errorf("%w: %s does not match its checksum", ErrInvalidBackup, name)
+		}
+	}
+
+	for name := range r.files {
+		if _, ok := r.manifest.files[name]; !ok {
+			return fmt.Errorf("%w: %s is not in the manifest", ErrInvalidBackup, name)
+		}
+	}
+
+	for name := range r.files {
+		target := name
+		if r.manifest.incremental {
+			id, err := nextSegment(r.dir)
+			if err != nil {
+				return err
+			}
+
+			target = segmentName(id)
+		}
+
+		if err := os.Rename(filepath.Join(r.dir, name+tmpExt), filepath.Join(r.dir, target)); err != nil {
+			return err
+		}
+
+		r.done = append(r.done, target)
+	}
+
+	// Backups of the first version do not say which LSN they reach.
+	if r.manifest.version < 2 {
+		return syncDir(r.dir)
+	}
+
+	return writeBackupLSN(r.dir, r.manifest.to, defaultFileMode)
+}
+
+func (r *restorer) abort() {
+	for name := range r.files {
+		_ = os.Remove(filepath.Join(r.dir, name+tmpExt))
+	}
+
+	for _, name := range r.done {
+		_ = os.Remove(filepath.Join(r.dir, name))
+	}
+}
+
+// nextSegment returns the id after the last segment in dir.
+func nextSegment(dir string) (uint32, error) {
+	ids, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(ids) > 0 {
+		return ids[len(ids)-1] + 1, nil
+	}
+
+	// The data file of older versions becomes segment 0.
+	legacy, err := hasLegacyFile(dir)
+	if err != nil || !legacy {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// parseManifest parses a manifest: a line with backupMagic and the version,
+// a line with the kind of backup and its LSNs, then a line per file with its
+// SHA-256, size and name. The first version has no kind line and is always
+// full.
+func parseManifest(b []byte) (*manifest, error) {
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	m := &manifest{}
+	if _, err := fmt.Sscanf(lines[0], backupMagic+" %d", &m.version); err != nil ||
+		lines[0] != fmt.Sprintf("%s %d", backupMagic, m.version) || m.version < 1 || m.version > backupVersion {
+		return nil, fmt.Errorf("%w: unknown manifest %q", ErrInvalidBackup, lines[0])
+	}
+
+	lines = lines[1:]
+	if m.version > 1 {
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("%w: manifest has no kind", ErrInvalidBackup)
+		}
+
+		fields := strings.Fields(lines[0])
+		var err error
+		switch {
+		case len(fields) == 2 && fields[0] == "full":
+			m.to, err = strconv.ParseUint(fields[1], 10, 64)
+		case len(fields) == 3 && fields[0] == "incremental":
+			m.incremental = true
+			if m.from, err = strconv.ParseUint(fields[1], 10, 64); err == nil {
+				m.to, err = strconv.ParseUint(fields[2], 10, 64)
+			}
+		default:
+			err = errors.New("unknown kind")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad manifest line %q", ErrInvalidBackup, lines[0])
+		}
+
+		lines = lines[1:]
+	}
+
+	m.files = make(map[string]manifestEntry, len(lines))
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: bad manifest line %q", ErrInvalidBackup, line)
+		}
+
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || !validBackupName(fields[2]) {
+			return nil, fmt.Errorf("%w: bad manifest line %q", ErrInvalidBackup, line)
+		}
+
+		m.files[fields[2]] = manifestEntry{sum: fields[0], size: size}
+	}
+
+	return m, nil
+}
+
+// validBackupName reports whether name is a plain file name that cannot
+// escape the directory it is restored to or replace a file Restore manages.
+func validBackupName(name string) bool {
+	switch name {
+	case "", ".", "..", manifestFile, backupLSNFile, lockFile, readLockFile:
+		return false
+	}
+
+	return name == filepath.Base(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// makeEmptyDir creates dir, or checks that it is empty if it exists.
+func makeEmptyDir(dir string, mode os.FileMode) error {
+	empty, err := prepareDir(dir, mode)
+	if err == nil && !empty {
+		err = fmt.Errorf("%s is not empty", dir)
+	}
+
+	return err
+}
+
+// prepareDir creates dir if it does not exist and reports whether it is
+// empty.
+func prepareDir(dir string, mode os.FileMode) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, os.MkdirAll(dir, dirMode(mode))
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return len(entries) == 0, nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// syncCloser syncs a file before closing it.
+type syncCloser struct {
+	*os.File
+}
+
+func (s syncCloser) Close() error {
+	err := s.File.Sync()
+	if closeErr := s.File.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,374 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func backupOptions() Options {
+	opts := testOptions()
+	opts.SegmentSize = 4 << 10
+	opts.ValueThreshold = 300
+	opts.ValueLogSize = 16 << 10
+	return opts
+}
+
+func TestBackupRestore(t *testing.T) {
+	d := openTest(t, t.TempDir(), backupOptions())
+	defer d.Close()
+
+	// Every batch sets a and b to the same value, a backup must never catch
+	// half of one.
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			value := []byte(fmt.Sprint(i))
+			if i%5 == 0 {
+				value = append(value, bytes.Repeat([]byte{'x'}, 400)...)
+			}
+
+			b := NewBatch()
+			b.Set(fmt.Sprint("a", i%10), value)
+			b.Set(fmt.Sprint("b", i%10), value)
+			if !assertNoError(t, d.Write(b)) {
+				return
+			}
+
+			if i%50 == 0 {
+				_ = d.Merge()
+				_ = d.CollectValueLogs()
+			}
+		}
+	}()
+
+	out := t.TempDir()
+	for i := 0; i < 3; i++ {
+		path := filepath.Join(out, fmt.Sprint(i, ".tar"))
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		_, err = d.Backup(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		dir := filepath.Join(out, fmt.Sprint(i))
+		_, err = d.BackupTo(dir)
+		require.NoError(t, err)
+
+		for j, src := range []string{path, dir} {
+			restored := filepath.Join(out, fmt.Sprint("restored", i, j))
+			require.NoError(t, Restore(src, restored))
+			r := openTest(t, restored, testOptions())
+			for k := 0; k < 10; k++ {
+				a, errA := r.Get(fmt.Sprint("a", k))
+				b, errB := r.Get(fmt.Sprint("b", k))
+				require.Equal(t, errA, errB)
+				require.Equal(t, a, b)
+			}
+			require.NoError(t, r.Close())
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	require.Error(t, Restore(filepath.Join(out, "0.tar"), filepath.Join(out, "0")))
+}
+
+func assertNoError(t *testing.T, err error) bool {
+	t.Helper()
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+
+	return true
+}
+
+func TestRestoreCorrupted(t *testing.T) {
+	d := openTest(t, t.TempDir(), backupOptions())
+	defer d.Close()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, d.Set(testKey(i), []byte("value")))
+	}
+
+	var buf bytes.Buffer
+	_, err := d.Backup(&buf)
+	require.NoError(t, err)
+	b := buf.Bytes()
+	b[1000] ^= 0xff
+
+	path := filepath.Join(t.TempDir(), "backup.tar")
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	dir := filepath.Join(t.TempDir(), "restored")
+	require.ErrorIs(t, Restore(path, dir), ErrInvalidBackup)
+
+	require.Zero(t, segmentsSize(t, dir))
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	opts := backupOptions()
+	opts.IncrementalBackups = true
+	d := openTest(t, t.TempDir(), opts)
+	defer d.Close()
+
+	_, err := d.BackupSince(&bytes.Buffer{}, 0)
+	require.ErrorIs(t, err, ErrLSNTooOld)
+
+	var (
+		want     = make(map[string]string)
+		rnd      = rand.New(rand.NewSource(1))
+		out      = t.TempDir()
+		restored = filepath.Join(out, "restored")
+		lsn      uint64
+	)
+	for step := 0; step < 9; step++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprint("k", rnd.Intn(60))
+			value := fmt.Sprint(step, i)
+			if rnd.Intn(4) == 0 {
+				value += string(bytes.Repeat([]byte{'x'}, 500))
+			}
+
+			switch rnd.Intn(6) {
+			case 0:
+				if err := d.Delete(key); err != ErrResourceNotFound {
+					require.NoError(t, err)
+				}
+				delete(want, key)
+			case 1:
+				b := NewBatch()
+				b.Set(key, []byte(value))
+				b.Set(key+"x", []byte(value))
+				require.NoError(t, d.Write(b))
+				want[key], want[key+"x"] = value, value
+			case 2:
+				require.NoError(t, d.SetEx(key, []byte(value), time.Millisecond))
+				delete(want, key)
+			default:
+				require.NoError(t, d.Set(key, []byte(value)))
+				want[key] = value
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if step%3 == 1 {
+			require.NoError(t, d.Merge())
+			require.NoError(t, d.CollectValueLogs())
+		}
+
+		path := filepath.Join(out, fmt.Sprint(step, ".tar"))
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		prev := lsn
+		if step == 0 {
+			lsn, err = d.Backup(f)
+		} else {
+			lsn, err = d.BackupSince(f, lsn)
+		}
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.Greater(t, lsn, prev)
+
+		if step > 1 {
+			_, err = d.BackupSince(&bytes.Buffer{}, prev)
+			require.ErrorIs(t, err, ErrLSNTooOld)
+		}
+
+		require.NoError(t, Restore(path, restored))
+		if step > 0 {
+			// It does not apply twice.
+			require.ErrorIs(t, Restore(path, restored), ErrInvalidBackup)
+		}
+
+		r := openTest(t, restored, testOptions())
+		requireValues(t, r, want)
+		require.Equal(t, lsn, r.LSN())
+		require.NoError(t, r.Close())
+	}
+
+	// An incremental backup needs its base.
+	path := filepath.Join(out, "last.tar")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	_, err = d.BackupSince(f, lsn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.ErrorIs(t, Restore(path, filepath.Join(out, "fresh")), ErrInvalidBackup)
+}
+
+func TestIncrementalBackupExpired(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	d := openTest(t, dir, opts)
+	require.NoError(t, d.Set("set", []byte("old")))
+	require.NoError(t, d.Set("expire", []byte("old")))
+
+	out := t.TempDir()
+	backup := func(name string, since uint64) (string, uint64) {
+		path := filepath.Join(out, name)
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		var lsn uint64
+		if since == 0 {
+			lsn, err = d.Backup(f)
+		} else {
+			lsn, err = d.BackupSince(f, since)
+		}
+		require.NoError(t, err)
+		return path, lsn
+	}
+
+	full, lsn := backup("full.tar", 0)
+	require.NoError(t, d.SetEx("set", []byte("new"), time.Millisecond))
+	require.NoError(t, d.Expire("expire", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	// Neither expiry wrote a delete, and Get drops the keys from the index.
+	for _, key := range []string{"set", "expire"} {
+		_, err := d.Get(key)
+		require.ErrorIs(t, err, ErrResourceNotFound)
+	}
+	require.NoError(t, d.Merge())
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	require.NoError(t, d.Merge())
+	incremental, _ := backup("incremental.tar", lsn)
+
+	restored := filepath.Join(out, "restored")
+	require.NoError(t, Restore(full, restored))
+	require.NoError(t, Restore(incremental, restored))
+	r := openTest(t, restored, testOptions())
+	defer r.Close()
+	requireValues(t, r, map[string]string{})
+}
+
+func TestMergeWithoutIncrementalBackups(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.IncrementalBackups = false
+	d := openTest(t, dir, opts)
+	defer d.Close()
+
+	lsn, err := d.Backup(&bytes.Buffer{})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, d.Set(testKey(i), []byte("value")))
+		require.NoError(t, d.Delete(testKey(i)))
+	}
+
+	// Before a merge, the deletes are still there.
+	_, err = d.BackupSince(io.Discard, lsn)
+	require.NoError(t, err)
+
+	lsn, err = d.Backup(io.Discard)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, d.Set(testKey(i), []byte("value")))
+		require.NoError(t, d.Delete(testKey(i)))
+	}
+	require.NoError(t, d.Merge())
+	require.Less(t, segmentsSize(t, dir), int64(1<<10))
+	_, err = d.BackupSince(&bytes.Buffer{}, lsn)
+	require.ErrorIs(t, err, ErrLSNTooOld)
+}
+
+func TestIncrementalBackupsRetention(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.IncrementalBackups = true
+	d := openTest(t, dir, opts)
+
+	lsn, err := d.Backup(&bytes.Buffer{})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, d.Set(testKey(i), []byte("value")))
+		require.NoError(t, d.Delete(testKey(i)))
+	}
+	require.NoError(t, d.Merge())
+	require.Zero(t, d.reclaimable.Load())
+	require.NoError(t, d.Close())
+
+	// The kept deletes are not reclaimable after a restart either.
+	d = openTest(t, dir, opts)
+	require.Zero(t, d.reclaimable.Load())
+	require.False(t, d.shouldMerge())
+	_, err = d.BackupSince(&bytes.Buffer{}, lsn)
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	// Once backed up, they go with the next merge.
+	size := segmentsSize(t, dir)
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	require.True(t, d.shouldMerge())
+	require.NoError(t, d.Merge())
+	require.Less(t, segmentsSize(t, dir), size/10)
+}
+
+func TestBackupReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	defer d.Close()
+	require.NoError(t, d.Set("a", []byte("1")))
+
+	opts := testOptions()
+	opts.ReadOnly = true
+	r := openTest(t, dir, opts)
+	defer r.Close()
+
+	lsn, err := r.Backup(&bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, backupLSNFile))
+	require.True(t, os.IsNotExist(err), err)
+
+	// The writer does not know about the cut, so nothing can follow it.
+	_, err = r.BackupSince(&bytes.Buffer{}, lsn)
+	require.ErrorIs(t, err, ErrLSNTooOld)
+
+	lsn, err = d.Backup(&bytes.Buffer{})
+	require.NoError(t, err)
+	_, err = r.BackupSince(&bytes.Buffer{}, lsn)
+	require.NoError(t, err)
+}
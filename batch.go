@@ -0,0 +1,94 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// Batch collects writes that Write applies all or nothing.
+type Batch struct {
+	ops []op
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Set(key string, value []byte) {
+	b.put(record.NewRecord(key, value, nil))
+}
+
+func (b *Batch) SetEx(key string, value []byte, ttl time.Duration) {
+	b.put(record.NewRecord(key, value, &ttl))
+}
+
+// Delete removes key. Unlike Daklak.Delete it does not fail when the key
+// does not exist.
+func (b *Batch) Delete(key string) {
+	o := newDelete(key)
+	o.r.Batch = true
+	b.ops = append(b.ops, o)
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+func (b *Batch) put(r *record.Record) {
+	r.Batch = true
+	b.ops = append(b.ops, newPut(r))
+}
+
+// Write commits the batch. Its records are written contiguously and followed
+// by a commit record holding their count and checksum; on open, records of a
+// batch without a valid commit record are ignored. The index only changes
+// once the whole batch is written and, unless SyncMode is SyncNone, synced.
+func (d *Daklak) Write(b *Batch) error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+
+	ops := make([]op, 0, len(b.ops)+1)
+	ops = append(ops, b.ops...)
+	if err := d.check(ops); err != nil {
+		return err
+	}
+
+	if err := d.encode(ops); err != nil {
+		return err
+	}
+
+	// The checksum is filled in once the records have their LSNs, see
+	// stamp.
+	ops = append(ops, op{
+		r:      record.NewBatchCommit(uint32(len(b.ops)), 0),
+		marker: true,
+	})
+
+	return d.commit(ops...)
+}
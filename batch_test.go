@@ -0,0 +1,101 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("a", []byte("1")))
+
+	b := NewBatch()
+	b.Set("b", []byte("2"))
+	b.Delete("a")
+	b.Delete("missing")
+	b.SetEx("c", []byte("3"), time.Hour)
+	require.Equal(t, 4, b.Len())
+	require.NoError(t, d.Write(b))
+	requireValues(t, d, map[string]string{"b": "2", "c": "3"})
+
+	b.Reset()
+	require.NoError(t, d.Write(b))
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, testOptions())
+	defer d.Close()
+	requireValues(t, d, map[string]string{"b": "2", "c": "3"})
+	ttl, err := d.TTL("c")
+	require.NoError(t, err)
+	require.Greater(t, ttl, time.Minute)
+}
+
+func TestBatchUncommitted(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("a", []byte("1")))
+
+	b := NewBatch()
+	b.Set("b", []byte("2"))
+	b.Delete("a")
+	require.NoError(t, d.Write(b))
+
+	b = NewBatch()
+	b.Set("d", []byte("4"))
+	b.Set("e", []byte("5"))
+	require.NoError(t, d.Write(b))
+
+	// Drop the commit record of the last batch, as if the process died
+	// before writing it.
+	var commit int64
+	seg := d.active
+	require.NoError(t, scanSegment(seg, nil, seg.start, seg.size, func(r *record.Record, _ []byte, offset int64) error {
+		if r.Header.Type == record.TypeBatchCommit {
+			commit = offset
+		}
+
+		return nil
+	}))
+	require.NoError(t, d.Close())
+	require.NoError(t, removeHint(dir, seg.id))
+	require.NoError(t, os.Truncate(filepath.Join(dir, segmentName(seg.id)), commit))
+
+	d = openTest(t, dir, testOptions())
+	requireValues(t, d, map[string]string{"b": "2"})
+
+	// The records left over must not be taken for part of a later batch.
+	b = NewBatch()
+	b.Set("f", []byte("6"))
+	require.NoError(t, d.Write(b))
+	require.NoError(t, d.Close())
+	require.NoError(t, removeHint(dir, seg.id))
+
+	d = openTest(t, dir, testOptions())
+	defer d.Close()
+	requireValues(t, d, map[string]string{"b": "2", "f": "6"})
+}
@@ -0,0 +1,44 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package benchmark
+
+import (
+	"testing"
+
+	"github.com/phamvinhdat/daklak/benchmark/utils"
+	"github.com/phamvinhdat/daklak/index"
+)
+
+func BenchmarkIndex(b *testing.B) {
+	b.Run("hash", func(b *testing.B) { benchmarkIndex(b, index.NewHash[int]()) })
+	b.Run("btree", func(b *testing.B) { benchmarkIndex(b, index.NewBTree[int]()) })
+	b.Run("radix", func(b *testing.B) { benchmarkIndex(b, index.NewRadix[int]()) })
+}
+
+func benchmarkIndex(b *testing.B, ix index.Indexer[int]) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		key := utils.GetTestKey(i)
+		ix.Put(key, i)
+		ix.Get(key)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package benchmark
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/phamvinhdat/daklak"
+)
+
+// TestConcurrentGetSet hammers one store with parallel readers and writers.
+// Every value starts with its key, so a read that returns the record of
+// another key is caught. Run it with -race.
+func TestConcurrentGetSet(t *testing.T) {
+	opts := daklak.DefaultOptions()
+	opts.SegmentSize = 64 << 10
+	opts.MergeInterval = 0
+	d, err := daklak.NewDaklakWithOptions(t.TempDir(), opts)
+	require.NoError(t, err)
+	defer d.Close()
+
+	const (
+		numKeys    = 512
+		numWorkers = 8
+		rounds     = 2000
+	)
+
+	value := func(key string, round int) []byte {
+		return []byte(fmt.Sprintf("%s|%d|%s", key, round, bytes.Repeat([]byte("v"), round%64)))
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		require.NoError(t, d.Set(key, value(key, 0)))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("key-%04d", (i*numWorkers+w)%numKeys)
+				assert.NoError(t, d.Set(key, value(key, i)))
+			}
+		}(w)
+
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				key := fmt.Sprintf("key-%04d", (i*7+w)%numKeys)
+				got, err := d.Get(key)
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				assert.True(t, bytes.HasPrefix(got, []byte(key+"|")), "read %q for key %s", got, key)
+			}
+		}(w)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, d.Merge())
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,387 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/phamvinhdat/daklak"
+	"github.com/phamvinhdat/daklak/rdb"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backup": {
+		usage: "backup [-since lsn] <path> <dest>\n\tback up the store at path, which may be open elsewhere, to the directory dest or, if dest ends in .tar, to a tar file,\n\tand print the LSN it reaches; with -since, only the changes after the LSN of the previous backup go to the tar file dest;\n\ta backup taken while the store is open elsewhere is not recorded, incremental backups cannot follow it",
+		run:   backup,
+	},
+	"rdb-load": {
+		usage: "rdb-load <path> <file>\n\twrite the string keys of the Redis RDB file to the store at path",
+		run:   rdbLoad,
+	},
+	"rdb-dump": {
+		usage: "rdb-dump <path> <file>\n\twrite every live key of the store at path to a new Redis RDB file",
+		run:   rdbDump,
+	},
+	"restore": {
+		usage: "restore <src> <path>\n\trebuild a store at path from the backup directory or tar file src, or apply the incremental backup src to it",
+		run:   restore,
+	},
+	"recover": {
+		usage: "recover (-lsn lsn | -time time) <path> <dest>\n\twrite the store at path as it was after the record with the LSN, or at the RFC 3339 time, to a new store at dest",
+		run:   recoverTo,
+	},
+	"export": {
+		usage: "export [-format jsonl|csv] <path> [file]\n\twrite every live key of the store at path with its value and TTL to file, or to standard output",
+		run:   export,
+	},
+	"import": {
+		usage: "import [-format jsonl|csv] <path> [file]\n\twrite the keys read from file, or from standard input, as written by export to the store at path",
+		run:   importKeys,
+	},
+	"migrate": {
+		usage: "migrate <path>\n\trewrite the store at path, including a legacy data.daklak file, in the current format",
+		run:   migrate,
+	},
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [arguments]\n\ncommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: migrate <path>")
+	}
+
+	return daklak.Migrate(fs.Arg(0))
+}
+
+func recoverTo(args []string) error {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	lsn := fs.Uint64("lsn", 0, "LSN of the last record to keep")
+	at := fs.String("time", "", "RFC 3339 time of the last record to keep")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 || (*lsn == 0) == (*at == "") {
+		return fmt.Errorf("usage: recover (-lsn lsn | -time time) <path> <dest>")
+	}
+
+	point := daklak.PointInTime{LSN: *lsn}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339Nano, *at)
+		if err != nil {
+			return err
+		}
+
+		point.Time = t
+	}
+
+	opts := daklak.DefaultOptions()
+	opts.ReadOnly = true
+	d, err := daklak.NewDaklakWithOptions(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.RecoverTo(fs.Arg(1), point)
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	name := fs.String("format", "jsonl", "jsonl or csv")
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("usage: export [-format jsonl|csv] <path> [file]")
+	}
+
+	format, err := exportFormat(*name)
+	if err != nil {
+		return err
+	}
+
+	opts := daklak.DefaultOptions()
+	opts.ReadOnly = true
+	d, err := daklak.NewDaklakWithOptions(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if fs.NArg() == 1 {
+		return d.Export(os.Stdout, format)
+	}
+
+	f, err := os.OpenFile(fs.Arg(1), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = d.Export(f, format); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(fs.Arg(1))
+	}
+
+	return err
+}
+
+func importKeys(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	name := fs.String("format", "jsonl", "jsonl or csv")
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf("usage: import [-format jsonl|csv] <path> [file]")
+	}
+
+	format, err := exportFormat(*name)
+	if err != nil {
+		return err
+	}
+
+	src := os.Stdin
+	if fs.NArg() == 2 {
+		if src, err = os.Open(fs.Arg(1)); err != nil {
+			return err
+		}
+		defer src.Close()
+	}
+
+	d, err := daklak.NewDaklak(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	err = d.Import(src, format)
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func rdbLoad(args []string) error {
+	fs := flag.NewFlagSet("rdb-load", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: rdb-load <path> <file>")
+	}
+
+	f, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d, err := daklak.NewDaklak(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	stats, err := rdb.Load(d, f)
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("loaded %d keys, %d had expired, skipped %d keys of other types", stats.Loaded, stats.Expired, stats.Skipped)
+	return nil
+}
+
+func rdbDump(args []string) error {
+	fs := flag.NewFlagSet("rdb-dump", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: rdb-dump <path> <file>")
+	}
+
+	opts := daklak.DefaultOptions()
+	opts.ReadOnly = true
+	d, err := daklak.NewDaklakWithOptions(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	f, err := os.OpenFile(fs.Arg(1), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = rdb.Dump(d, f); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(fs.Arg(1))
+	}
+
+	return err
+}
+
+func exportFormat(name string) (daklak.ExportFormat, error) {
+	switch name {
+	case "jsonl":
+		return daklak.ExportJSONL, nil
+	case "csv":
+		return daklak.ExportCSV, nil
+	}
+
+	return 0, fmt.Errorf("unknown format %q, want jsonl or csv", name)
+}
+
+func backup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	since := fs.Uint64("since", 0, "LSN of the previous backup")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: backup [-since lsn] <path> <dest>")
+	}
+
+	incremental := false
+	fs.Visit(func(f *flag.Flag) { incremental = incremental || f.Name == "since" })
+
+	// Only a writable open records the backup for incremental ones to
+	// follow; next to the writer the store can only be read.
+	opts := daklak.DefaultOptions()
+	opts.MergeInterval = 0
+	opts.SweepInterval = 0
+	d, err := daklak.NewDaklakWithOptions(fs.Arg(0), opts)
+	if errors.Is(err, daklak.ErrLocked) {
+		opts.ReadOnly = true
+		d, err = daklak.NewDaklakWithOptions(fs.Arg(0), opts)
+		if err == nil && !incremental {
+			fmt.Fprintln(os.Stderr, "the store is open elsewhere, the backup is not recorded")
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	dest := fs.Arg(1)
+	if !strings.HasSuffix(dest, ".tar") {
+		if incremental {
+			return fmt.Errorf("an incremental backup goes to a .tar file")
+		}
+
+		lsn, err := d.BackupTo(dest)
+		if err == nil {
+			fmt.Println(lsn)
+		}
+
+		return err
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	var lsn uint64
+	if incremental {
+		lsn, err = d.BackupSince(f, *since)
+	} else {
+		lsn, err = d.Backup(f)
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(dest)
+		return err
+	}
+
+	fmt.Println(lsn)
+	return nil
+}
+
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: restore <src> <path>")
+	}
+
+	return daklak.Restore(fs.Arg(0), fs.Arg(1))
+}
@@ -0,0 +1,125 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+// segmentCodecs returns the codec of the latest record of every key in each
+// segment of d.
+func segmentCodecs(t *testing.T, d *Daklak) map[uint32]map[string]record.CodecID {
+	t.Helper()
+	d.segMu.RLock()
+	defer d.segMu.RUnlock()
+
+	codecs := make(map[uint32]map[string]record.CodecID)
+	for id, seg := range d.segments {
+		codecs[id] = make(map[string]record.CodecID)
+		err := scanSegment(seg, d.opts.KeyProvider, seg.start, seg.size, func(r *record.Record, _ []byte, _ int64) error {
+			codecs[id][r.Key] = r.Header.Codec
+			return nil
+		})
+		require.NoError(t, err)
+	}
+
+	return codecs
+}
+
+func TestCompression(t *testing.T) {
+	var (
+		small        = bytes.Repeat([]byte("a"), 32)
+		compressible = bytes.Repeat([]byte("a"), 256)
+		random       = randomValue(256, 1)
+	)
+	tests := map[string]struct {
+		compression record.Compression
+		want        map[string]record.CodecID
+	}{
+		"none": {
+			compression: record.Compression{Codec: record.CodecNone},
+			want:        map[string]record.CodecID{"small": record.CodecNone, "compressible": record.CodecNone, "random": record.CodecNone},
+		},
+		"snappy": {
+			compression: record.Compression{Codec: record.CodecSnappy},
+			want:        map[string]record.CodecID{"small": record.CodecSnappy, "compressible": record.CodecSnappy, "random": record.CodecSnappy},
+		},
+		"min size": {
+			compression: record.Compression{Codec: record.CodecSnappy, MinSize: 64},
+			want:        map[string]record.CodecID{"small": record.CodecNone, "compressible": record.CodecSnappy, "random": record.CodecSnappy},
+		},
+		"max ratio": {
+			compression: record.Compression{Codec: record.CodecSnappy, MaxRatio: 0.9},
+			want:        map[string]record.CodecID{"small": record.CodecSnappy, "compressible": record.CodecSnappy, "random": record.CodecNone},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := testOptions()
+			opts.ValueThreshold = 0
+			opts.Compression = test.compression
+			d := openTest(t, t.TempDir(), opts)
+			defer d.Close()
+
+			values := map[string][]byte{"small": small, "compressible": compressible, "random": random}
+			for key, value := range values {
+				require.NoError(t, d.Set(key, value))
+			}
+
+			require.Equal(t, test.want, segmentCodecs(t, d)[d.active.id])
+			for key, value := range values {
+				got, err := d.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, value, got, key)
+			}
+		})
+	}
+}
+
+func TestCompressionChange(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.Compression = record.Compression{Codec: record.CodecNone}
+	d := openTest(t, dir, opts)
+	require.NoError(t, d.Set("none", bytes.Repeat([]byte("a"), 256)))
+	require.NoError(t, d.Close())
+
+	opts.Compression = record.Compression{Codec: record.CodecSnappy}
+	d = openTest(t, dir, opts)
+	require.NoError(t, d.Set("snappy", bytes.Repeat([]byte("b"), 256)))
+	require.Equal(t, map[uint32]map[string]record.CodecID{
+		d.active.id: {"none": record.CodecNone, "snappy": record.CodecSnappy},
+	}, segmentCodecs(t, d))
+	require.NoError(t, d.Close())
+
+	// Every record is read with its own codec, whatever the options say.
+	want := map[string]string{"none": string(bytes.Repeat([]byte("a"), 256)), "snappy": string(bytes.Repeat([]byte("b"), 256))}
+	opts.Compression = record.Compression{Codec: record.CodecNone}
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	requireValues(t, d, want)
+	require.NoError(t, d.Merge())
+	requireValues(t, d, want)
+}
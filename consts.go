@@ -20,7 +20,39 @@
 
 package daklak
 
+import (
+	"os"
+	"time"
+)
+
 const (
-	defaultPath = "./"
-	dataFile    = "data.daklak"
+	defaultPath             = "./"
+	dataFile                = "data.daklak"
+	segmentExt              = ".daklak"
+	hintExt                 = ".hint"
+	valueLogExt             = ".vlog"
+	tmpExt                  = ".tmp"
+	lockFile                = "LOCK"
+	readLockFile            = "LOCK.read"
+	manifestFile            = "MANIFEST"
+	backupLSNFile           = "BACKUP_LSN"
+	valueLogIDFile          = "VLOG_ID"
+	changesFile             = "changes.daklak"
+	backupMagic             = "daklak-backup"
+	backupVersion           = 2
+	defaultSegmentSize      = 256 << 20
+	defaultMergeRatio       = 0.5
+	defaultReadHandles      = 4
+	defaultSyncInterval     = time.Second
+	defaultSweepInterval    = 100 * time.Millisecond
+	defaultSweepLimit       = 1000
+	defaultCompressMinSize  = 64
+	defaultCompressMaxRatio = 0.9
+	defaultValueThreshold   = 64 << 10
+	defaultValueLogSize     = 1 << 30
+	defaultValueLogGCRatio  = 0.5
+	defaultMaxKeySize       = 64 << 10
+	defaultMaxValueSize     = 256 << 20
+	defaultFileMode         = os.FileMode(0644)
+	importBatchSize         = 1024
 )
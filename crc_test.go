@@ -0,0 +1,124 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+func checksumOptions() Options {
+	opts := testOptions()
+	opts.Compression = record.Compression{Codec: record.CodecNone}
+	return opts
+}
+
+// flip changes the last occurrence of s in the file at path.
+func flip(t *testing.T, path, s string) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	i := bytes.LastIndex(b, []byte(s))
+	require.GreaterOrEqual(t, i, 0)
+	b[i] ^= 1
+	require.NoError(t, os.WriteFile(path, b, 0644))
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, checksumOptions())
+	require.NoError(t, d.Set("a", []byte("value-of-a")))
+	require.NoError(t, d.Set("b", []byte("value-of-b")))
+	require.NoError(t, d.Close())
+
+	path := filepath.Join(dir, segmentName(0))
+	flip(t, path, "value-of-b")
+
+	// The hint is still good, so the segment is not scanned.
+	d = openTest(t, dir, checksumOptions())
+	_, err := d.Get("b")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.ErrorIs(t, err, ErrCorrupted)
+	var corruption *CorruptionError
+	require.True(t, errors.As(err, &corruption))
+	require.Equal(t, path, corruption.Path)
+	v, err := d.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "value-of-a", string(v))
+	require.NoError(t, d.Close())
+
+	opts := checksumOptions()
+	opts.VerifyChecksums = false
+	d = openTest(t, dir, opts)
+	v, err = d.Get("b")
+	require.NoError(t, err)
+	require.NotEqual(t, "value-of-b", string(v))
+	require.NoError(t, d.Close())
+
+	require.NoError(t, removeHint(dir, 0))
+	opts.Recovery = RecoveryStrict
+	_, err = NewDaklakWithOptions(dir, opts)
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	d = openTest(t, dir, checksumOptions())
+	defer d.Close()
+	requireValues(t, d, map[string]string{"a": "value-of-a"})
+	require.Equal(t, []string{path}, d.Recovery().Segments)
+}
+
+func TestChecksumMismatchKey(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, checksumOptions())
+	require.NoError(t, d.Set("aaaa", []byte("1")))
+	require.NoError(t, d.Set("bbbb", []byte("2")))
+	require.NoError(t, d.Close())
+
+	flip(t, filepath.Join(dir, segmentName(0)), "bbbb")
+	d = openTest(t, dir, checksumOptions())
+	defer d.Close()
+	_, err := d.Get("bbbb")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestChecksumMismatchValueLog(t *testing.T) {
+	dir := t.TempDir()
+	opts := checksumOptions()
+	opts.ValueThreshold = 16
+	d := openTest(t, dir, opts)
+	defer d.Close()
+
+	value := strings.Repeat("large", 10)
+	require.NoError(t, d.Set("large", []byte(value)))
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+valueLogExt))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	flip(t, paths[0], value)
+
+	_, err = d.Get("large")
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+	require.ErrorIs(t, err, ErrCorrupted)
+}
@@ -0,0 +1,150 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+func keyRing(t *testing.T, ids ...uint32) *record.KeyRing {
+	t.Helper()
+	ring := record.NewKeyRing()
+	for _, id := range ids {
+		require.NoError(t, ring.Add(id, bytes.Repeat([]byte{byte(id)}, 32)))
+	}
+
+	return ring
+}
+
+// requireNoPlaintext checks that no file of dir contains s.
+func requireNoPlaintext(t *testing.T, dir, s string) {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NotContains(t, string(b), s, path)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.KeyProvider = keyRing(t, 1)
+	d := openTest(t, dir, opts)
+
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key, value := fmt.Sprint("secret-key-", i), fmt.Sprint("secret-value-", i)
+		require.NoError(t, d.Set(key, []byte(value)))
+		want[key] = value
+	}
+	require.NoError(t, d.Delete("secret-key-3"))
+	delete(want, "secret-key-3")
+	require.NoError(t, d.Close())
+	requireNoPlaintext(t, dir, "secret")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, hintName(0))))
+	opts.KeyProvider = keyRing(t, 2)
+	_, err := NewDaklakWithOptions(dir, opts)
+	require.ErrorIs(t, err, record.ErrUnknownKey)
+
+	wrong := record.NewKeyRing()
+	require.NoError(t, wrong.Add(1, bytes.Repeat([]byte{9}, 32)))
+	opts.KeyProvider = wrong
+	_, err = NewDaklakWithOptions(dir, opts)
+	require.ErrorIs(t, err, record.ErrDecryptionFailed)
+
+	// Rotate to key 2; once merged, key 1 is no longer needed.
+	opts.KeyProvider = keyRing(t, 1, 2)
+	d = openTest(t, dir, opts)
+	requireValues(t, d, want)
+	require.NoError(t, d.Merge())
+	require.NoError(t, d.Close())
+
+	opts.KeyProvider = keyRing(t, 2)
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	requireValues(t, d, want)
+	requireNoPlaintext(t, dir, "secret")
+}
+
+func TestEncryptionRotatesValueLogs(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.KeyProvider = keyRing(t, 1)
+	opts.ValueThreshold = 100
+	opts.ValueLogSize = 1 << 10
+	d := openTest(t, dir, opts)
+
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		value := fmt.Sprint(i, string(bytes.Repeat([]byte{'x'}, 200)))
+		require.NoError(t, d.Set(testKey(i), []byte(value)))
+		want[testKey(i)] = value
+	}
+	require.NoError(t, d.Close())
+
+	// Reopened, so the sealed value logs have to be read for their keys.
+	opts.KeyProvider = keyRing(t, 1, 2)
+	d = openTest(t, dir, opts)
+	require.NoError(t, d.Set("after", bytes.Repeat([]byte{'y'}, 200)))
+	want["after"] = string(bytes.Repeat([]byte{'y'}, 200))
+	require.NoError(t, d.Merge())
+	require.NoError(t, d.CollectValueLogs())
+	require.NoError(t, d.Close())
+
+	opts.KeyProvider = keyRing(t, 2)
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	requireValues(t, d, want)
+}
+
+func TestEncryptionRotatesActiveValueLog(t *testing.T) {
+	dir := t.TempDir()
+	ring := keyRing(t, 1)
+	opts := testOptions()
+	opts.KeyProvider = ring
+	opts.ValueThreshold = 100
+	d := openTest(t, dir, opts)
+
+	value := bytes.Repeat([]byte{'x'}, 200)
+	require.NoError(t, d.Set("a", value))
+	require.NoError(t, ring.Add(2, bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, d.Merge())
+	require.NoError(t, d.CollectValueLogs())
+
+	require.NoError(t, d.Close())
+
+	opts.KeyProvider = keyRing(t, 2)
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	got, err := d.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+}
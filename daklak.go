@@ -21,142 +21,429 @@
 package daklak
 
 import (
-	"io"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/phamvinhdat/daklak/record"
 )
 
-var (
-	mKeys      *sync.Map
-	lastOffset int64
-)
+// entry locates the latest record of a key.
+type entry struct {
+	segment   uint32
+	offset    int64
+	size      int64
+	expiresAt int64
+
+	// value locates the value when it is kept in a value log.
+	value *record.ValuePointer
+
+	// lsn is the LSN of the latest write to the key, which may be a later
+	// change of its expiry.
+	lsn uint64
+}
 
-func MapKeys() *sync.Map {
-	return mKeys
+// sameRecord reports whether e and o point at the same record, whatever
+// expiry was set on it since.
+func (e entry) sameRecord(o entry) bool {
+	return e.segment == o.segment && e.offset == o.offset
+}
+
+func (e entry) expired(now time.Time) bool {
+	return e.expiresAt != 0 && e.expiresAt <= now.UnixMilli()
 }
 
 type Daklak struct {
+	// mu serializes writes to the active segment.
 	mu     sync.RWMutex
-	reader *os.File
-	writer io.WriteCloser
+	path   string
+	opts   Options
+	lock   *dirLock
+	active *segment
+
+	// segMu guards segments; readers hold it while they read from a segment
+	// so it is not closed under them. When both are needed, mu is taken
+	// first.
+	segMu    sync.RWMutex
+	segments map[uint32]*segment
+
+	// vlogs are the value logs, guarded by segMu like segments. Values are
+	// appended to vlog under vlogMu, which is taken after mu and before
+	// segMu. vlog is nil until the first value is written after opening.
+	// nextVlog is the id of the next value log, guarded by vlogMu; ids are
+	// never reused, records may still point into a removed value log.
+	vlogMu   sync.Mutex
+	vlog     *valueLog
+	vlogs    map[uint32]*valueLog
+	nextVlog uint32
+
+	// keys maps every live key to its entry, expiries queues the ones with a
+	// TTL. Both are only changed under mu.
+	keys     keydir
+	expiries *expiryQueue
+
+	// lsn is the LSN of the latest record and cuts counts the backups in
+	// progress by the LSN they were cut at, both guarded by mu. lastLSN
+	// mirrors lsn for the writers that do not hold mu.
+	lsn     uint64
+	cuts    map[uint64]int
+	lastLSN atomic.Uint64
+
+	// reclaimable counts the bytes held by overwritten, deleted and expired
+	// records that a merge would drop.
+	reclaimable atomic.Int64
+	recovery    RecoveryReport
+	merging     atomic.Bool
+	pendingMu   sync.Mutex
+	pending     []*writeRequest
+	closing     atomic.Bool
+	closed      chan struct{}
+	wg          sync.WaitGroup
 }
 
 func NewDaklak(path string) (*Daklak, error) {
-	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+	return NewDaklakWithOptions(path, DefaultOptions())
+}
+
+// NewDaklakWithOptions opens the store at path, creating it unless
+// opts.ReadOnly is set. opts are validated first, see Options.Validate.
+//
+// The directory is locked for as long as the store is open: opening it for
+// writing again, from this process or another, fails with ErrLocked.
+// Read-only opens share a separate lock and can run next to the writer; they
+// see the store as it was when they opened it.
+func NewDaklakWithOptions(path string, opts Options) (*Daklak, error) {
+	if err := opts.Validate(); err != nil {
 		return nil, err
 	}
 
-	filePath := filepath.Join(path, dataFile)
-	writer, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if !opts.ReadOnly {
+		if err := os.MkdirAll(path, dirMode(opts.FileMode)); err != nil {
+			return nil, err
+		}
+	}
+
+	lock, err := lockDir(path, opts.ReadOnly, opts.FileMode)
 	if err != nil {
 		return nil, err
 	}
 
-	reader, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	d, err := openStore(path, opts, lock)
 	if err != nil {
+		_ = lock.release()
 		return nil, err
 	}
 
-	mKeys, err = load(reader)
+	return d, nil
+}
+
+// openStore opens the store at path, whose directory is locked by lock.
+func openStore(path string, opts Options, lock *dirLock) (*Daklak, error) {
+	var legacy bool
+	if opts.ReadOnly {
+		// The data file of older versions cannot be renamed, it is read in
+		// place.
+		var err error
+		if legacy, err = hasLegacyFile(path); err != nil {
+			return nil, err
+		}
+	} else if err := tidyDir(path); err != nil {
+		return nil, err
+	}
+
+	ids, err := listSegments(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Daklak{
-		reader: reader,
-		writer: writer,
-	}, nil
+	if legacy {
+		ids = append([]uint32{0}, ids...)
+	}
+
+	if len(ids) == 0 {
+		if opts.ReadOnly {
+			return nil, fmt.Errorf("no store in %s: %w", path, os.ErrNotExist)
+		}
+
+		ids = []uint32{0}
+	}
+
+	d := &Daklak{
+		path:     path,
+		opts:     opts,
+		lock:     lock,
+		segments: make(map[uint32]*segment, len(ids)),
+		vlogs:    make(map[uint32]*valueLog),
+		closed:   make(chan struct{}),
+	}
+
+	ordered := make([]*segment, 0, len(ids))
+	for i, id := range ids {
+		writable := i == len(ids)-1 && !opts.ReadOnly
+		var seg *segment
+		if legacy && i == 0 {
+			seg, err = openSegmentFile(filepath.Join(path, dataFile), id, false, opts.ReadHandles, opts.FileMode)
+		} else {
+			seg, err = openSegment(path, id, writable, opts.ReadHandles, opts.FileMode)
+		}
+
+		if err != nil {
+			_ = d.closeSegments()
+			return nil, err
+		}
+
+		d.segments[id] = seg
+		ordered = append(ordered, seg)
+	}
+
+	d.active = ordered[len(ordered)-1]
+	if err = d.load(ordered); err != nil {
+		_ = d.closeSegments()
+		return nil, err
+	}
+
+	if err = d.openValueLogs(); err != nil {
+		_ = d.closeSegments()
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		return d, nil
+	}
+
+	if (d.recovered(d.active) && opts.Recovery == RecoveryLenient) || d.active.header.version != formatVersion {
+		// Never append after a bad tail that is left in place, nor to a
+		// segment of an older format.
+		if err = d.rotate(); err != nil {
+			_ = d.closeSegments()
+			return nil, err
+		}
+	}
+
+	if opts.MergeInterval > 0 {
+		d.wg.Add(1)
+		go d.mergeLoop()
+	}
+
+	if opts.SyncMode == SyncInterval {
+		d.wg.Add(1)
+		go d.syncLoop()
+	}
+
+	if opts.SweepInterval > 0 {
+		d.wg.Add(1)
+		go d.sweepLoop()
+	}
+
+	return d, nil
 }
 
 func (d *Daklak) Get(key string) ([]byte, error) {
-	offset, ok := mKeys.Load(key)
-	if !ok {
+	d.segMu.RLock()
+	r, e, err := d.read(key)
+	d.segMu.RUnlock()
+	if err == errExpired {
+		d.expire(key, e)
 		return nil, ErrResourceNotFound
 	}
 
-	off := offset.(int64)
-	_, err := d.reader.Seek(off, 0)
 	if err != nil {
 		return nil, err
 	}
 
+	return r.Value, nil
+}
+
+// read looks key up and reads its record with a single positional read. The
+// caller must hold d.segMu.
+func (d *Daklak) read(key string) (*record.Record, entry, error) {
+	e, ok := d.keys.Get(key)
+	if !ok {
+		return nil, entry{}, ErrResourceNotFound
+	}
+
+	if e.expired(time.Now()) {
+		return nil, e, errExpired
+	}
+
+	seg := d.segments[e.segment]
+	b := make([]byte, e.size)
+	if err := seg.readAt(b, e.offset); err != nil {
+		return nil, entry{}, err
+	}
+
+	if d.opts.VerifyChecksums {
+		if err := record.Verify(b, seg.format()); err != nil {
+			return nil, entry{}, &CorruptionError{Path: seg.path, Offset: e.offset, Err: err}
+		}
+	}
+
 	r := &record.Record{}
-	if err = r.FromReader(d.reader); err != nil {
-		return nil, err
+	if err := r.UnmarshalFormat(b, seg.format(), d.opts.KeyProvider); err != nil {
+		return nil, entry{}, &CorruptionError{Path: seg.path, Offset: e.offset, Err: err}
 	}
 
-	if !r.Valid() {
-		mKeys.Delete(key)
-		return nil, ErrResourceNotFound
+	if r.Pointer != nil {
+		value, err := d.readValue(key, r.LSN, *r.Pointer)
+		if err != nil {
+			return nil, entry{}, err
+		}
+
+		r.Value = value
 	}
 
-	return r.Value, nil
+	return r, e, nil
 }
 
-func (d *Daklak) Set(key string, value []byte) error {
-	r := record.NewRecord(key, value, nil)
-	b := r.Marshal()
-
+// expire removes key from the index if it still points at e, whose record
+// has expired.
+func (d *Daklak) expire(key string, e entry) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	n, err := d.writer.Write(b)
-	if err != nil {
-		return err
+	if cur, ok := d.keys.Get(key); ok && cur == e {
+		d.keys.Delete(key)
+		d.expiries.remove(key)
+		d.release(e)
 	}
+}
 
-	mKeys.Store(key, lastOffset)
-	lastOffset += int64(n)
-	return nil
+func (d *Daklak) logf(format string, v ...any) {
+	if d.opts.Logger != nil {
+		d.opts.Logger.Printf(format, v...)
+	}
+}
+
+func (d *Daklak) Set(key string, value []byte) error {
+	return d.commit(newPut(record.NewRecord(key, value, nil)))
 }
 
 func (d *Daklak) SetEx(key string, value []byte, ttl time.Duration) error {
-	r := record.NewRecord(key, value, &ttl)
-	b := r.Marshal()
+	return d.commit(newPut(record.NewRecord(key, value, &ttl)))
+}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	n, err := d.writer.Write(b)
-	if err != nil {
-		return err
+func (d *Daklak) Delete(key string) error {
+	if _, ok := d.keys.Get(key); !ok {
+		return ErrResourceNotFound
 	}
 
-	mKeys.Store(key, lastOffset)
-	lastOffset += int64(n)
-	return nil
+	return d.commit(newDelete(key))
 }
 
-func (d *Daklak) Delete(key string) error {
-	if _, ok := mKeys.Load(key); !ok {
-		return ErrResourceNotFound
+// Range calls fn for every live key, in no particular order, until fn
+// returns false. fn may write to the store.
+func (d *Daklak) Range(fn func(key string) bool) {
+	now := time.Now()
+	d.keys.Iterate(func(key string, e entry) bool {
+		if e.expired(now) {
+			return true
+		}
+
+		return fn(key)
+	})
+}
+
+func (d *Daklak) Close() error {
+	if !d.closing.CompareAndSwap(false, true) {
+		return ErrClosed
 	}
 
-	r := record.NewRecord(key, []byte{}, nil)
-	b := r.Marshal()
+	close(d.closed)
+	d.wg.Wait()
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	n, err := d.writer.Write(b)
-	if err != nil {
-		return err
+	d.vlogMu.Lock()
+	defer d.vlogMu.Unlock()
+	d.segMu.Lock()
+	defer d.segMu.Unlock()
+
+	returnErr := d.active.seal()
+	if d.vlog != nil {
+		if err := d.vlog.seal(); err != nil {
+			returnErr = err
+		}
 	}
 
-	mKeys.Delete(key)
-	lastOffset += int64(n)
-	return nil
-}
+	if !d.opts.ReadOnly {
+		if err := d.writeHints(); err != nil {
+			returnErr = err
+		}
+	}
 
-func (d *Daklak) Close() error {
-	var returnErr error
-	if err := d.writer.Close(); err != nil {
+	if err := d.closeSegments(); err != nil {
 		returnErr = err
 	}
 
-	if err := d.reader.Close(); err != nil {
+	if err := d.lock.release(); err != nil {
 		returnErr = err
 	}
 
 	return returnErr
 }
+
+func (d *Daklak) closeSegments() error {
+	var returnErr error
+	for _, seg := range d.segments {
+		if err := seg.close(); err != nil {
+			returnErr = err
+		}
+	}
+
+	for _, vl := range d.vlogs {
+		if err := vl.close(); err != nil {
+			returnErr = err
+		}
+	}
+
+	return returnErr
+}
+
+// writeHints writes a hint file for every segment that does not have an up to
+// date one, so the next open does not have to scan them. The caller must hold
+// d.mu and d.segMu.
+func (d *Daklak) writeHints() error {
+	for _, seg := range d.segments {
+		if seg.hinted {
+			continue
+		}
+
+		entries, _, err := segmentEntries(d.path, seg, d.opts.KeyProvider)
+		if err != nil {
+			return err
+		}
+
+		if err = writeHint(d.path, seg.id, seg.size, entries, d.opts.KeyProvider, d.opts.FileMode); err != nil {
+			return err
+		}
+
+		seg.hinted = true
+	}
+
+	return nil
+}
+
+// rotate seals the active segment and opens the next one for writing. The
+// caller must hold d.mu.
+func (d *Daklak) rotate() error {
+	return d.rotateTo(d.active.id + 1)
+}
+
+func (d *Daklak) rotateTo(id uint32) error {
+	if err := d.active.seal(); err != nil {
+		return err
+	}
+
+	seg, err := openSegment(d.path, id, true, d.opts.ReadHandles, d.opts.FileMode)
+	if err != nil {
+		return err
+	}
+
+	d.segMu.Lock()
+	d.segments[seg.id] = seg
+	d.segMu.Unlock()
+	d.active = seg
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+// testOptions returns options without background work, so tests decide when
+// merges and sweeps run.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.MergeInterval = 0
+	opts.SweepInterval = 0
+	return opts
+}
+
+func openTest(t *testing.T, dir string, opts Options) *Daklak {
+	t.Helper()
+	d, err := NewDaklakWithOptions(dir, opts)
+	require.NoError(t, err)
+	return d
+}
+
+// requireValues checks that d holds exactly want.
+func requireValues(t *testing.T, d *Daklak, want map[string]string) {
+	t.Helper()
+	count := 0
+	d.Range(func(string) bool {
+		count++
+		return true
+	})
+	require.Equal(t, len(want), count)
+
+	for key, value := range want {
+		got, err := d.Get(key)
+		require.NoError(t, err, key)
+		require.Equal(t, value, string(got), key)
+	}
+}
+
+func testKey(i int) string {
+	return fmt.Sprintf("key-%04d", i)
+}
+
+func TestRangeDeletes(t *testing.T) {
+	for _, index := range []IndexType{IndexHash, IndexBTree, IndexRadix} {
+		opts := testOptions()
+		opts.Index = index
+		d := openTest(t, t.TempDir(), opts)
+		for i := 0; i < 500; i++ {
+			require.NoError(t, d.Set(testKey(i), []byte("v")))
+		}
+
+		d.Range(func(key string) bool {
+			require.NoError(t, d.Delete(key))
+			return true
+		})
+		requireValues(t, d, map[string]string{})
+		require.NoError(t, d.Close())
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.SegmentSize = 1 << 10
+	d := openTest(t, dir, opts)
+
+	want := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		value := fmt.Sprint("value-", i)
+		require.NoError(t, d.Set(testKey(i), []byte(value)))
+		want[testKey(i)] = value
+	}
+	require.Greater(t, len(d.segments), 5)
+	for _, seg := range d.segments {
+		require.LessOrEqual(t, seg.size, opts.SegmentSize, seg.path)
+	}
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, opts)
+	requireValues(t, d, want)
+	require.NoError(t, d.Close())
+
+	// The same without hint files, from the segments alone.
+	hints, err := filepath.Glob(filepath.Join(dir, "*"+hintExt))
+	require.NoError(t, err)
+	require.NotEmpty(t, hints)
+	for _, hint := range hints {
+		require.NoError(t, os.Remove(hint))
+	}
+
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	requireValues(t, d, want)
+}
+
+func TestTwoStores(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	stores := make([]*Daklak, len(dirs))
+	for i, dir := range dirs {
+		stores[i] = openTest(t, dir, testOptions())
+	}
+
+	var wg sync.WaitGroup
+	for i, d := range stores {
+		wg.Add(1)
+		go func(i int, d *Daklak) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				require.NoError(t, d.Set(testKey(j), []byte(fmt.Sprint(i, j))))
+			}
+			for j := 0; j < 500; j += 2 {
+				require.NoError(t, d.Delete(testKey(j)))
+			}
+		}(i, d)
+	}
+	wg.Wait()
+
+	// Each store only holds its own writes, before and after a reopen.
+	for i, dir := range dirs {
+		want := make(map[string]string)
+		for j := 1; j < 500; j += 2 {
+			want[testKey(j)] = fmt.Sprint(i, j)
+		}
+		requireValues(t, stores[i], want)
+		require.NoError(t, stores[i].Close())
+
+		d := openTest(t, dir, testOptions())
+		requireValues(t, d, want)
+		require.NoError(t, d.Close())
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("a", []byte("1")))
+	require.NoError(t, d.Close())
+	require.ErrorIs(t, d.Close(), ErrClosed)
+
+	// The second Close does not release the lock of the next store.
+	d2 := openTest(t, dir, testOptions())
+	require.ErrorIs(t, d.Close(), ErrClosed)
+	value, err := d2.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "1", string(value))
+	require.NoError(t, d2.Close())
+}
+
+func TestEmptyValue(t *testing.T) {
+	tests := map[string]func(opts *Options){
+		"snappy": func(*Options) {},
+		"none": func(opts *Options) {
+			opts.Compression = record.Compression{Codec: record.CodecNone}
+		},
+		"encrypted": func(opts *Options) {
+			opts.KeyProvider = keyRing(t, 1)
+		},
+	}
+
+	for name, setup := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := testOptions()
+			setup(&opts)
+			d := openTest(t, dir, opts)
+			require.NoError(t, d.Set("empty", []byte{}))
+			require.NoError(t, d.Set("nil", nil))
+			require.NoError(t, d.SetEx("ttl", []byte{}, time.Hour))
+			b := NewBatch()
+			b.Set("batch", []byte{})
+			require.NoError(t, d.Write(b))
+			require.NoError(t, d.Set("deleted", []byte("1")))
+			require.NoError(t, d.Delete("deleted"))
+
+			want := map[string]string{"empty": "", "nil": "", "ttl": "", "batch": ""}
+			requireValues(t, d, want)
+			require.NoError(t, d.Close())
+
+			d = openTest(t, dir, opts)
+			requireValues(t, d, want)
+			require.NoError(t, d.Merge())
+			require.NoError(t, d.Close())
+
+			d = openTest(t, dir, opts)
+			defer d.Close()
+			requireValues(t, d, want)
+			v, err := d.Get("empty")
+			require.NoError(t, err)
+			require.NotNil(t, v)
+			_, err = d.Get("deleted")
+			require.ErrorIs(t, err, ErrResourceNotFound)
+			require.NoError(t, d.Delete("empty"))
+			_, err = d.Get("empty")
+			require.ErrorIs(t, err, ErrResourceNotFound)
+		})
+	}
+}
@@ -20,8 +20,72 @@
 
 package daklak
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/phamvinhdat/daklak/record"
+)
 
 var (
 	ErrResourceNotFound = errors.New("ERR_RESOURCE_NOT_FOUND")
+	ErrMergeInProgress  = errors.New("ERR_MERGE_IN_PROGRESS")
+	ErrCorrupted        = errors.New("ERR_CORRUPTED")
+	ErrReadOnly         = errors.New("ERR_READ_ONLY")
+	ErrLocked           = errors.New("ERR_LOCKED")
+	ErrKeyTooLarge      = errors.New("ERR_KEY_TOO_LARGE")
+	ErrValueTooLarge    = errors.New("ERR_VALUE_TOO_LARGE")
+	// ErrClosed is returned by Close for a store that is closed already.
+	ErrClosed = errors.New("ERR_CLOSED")
+	// ErrInvalidOptions is matched by the errors of Options.Validate.
+	ErrInvalidOptions = errors.New("ERR_INVALID_OPTIONS")
+	// ErrInvalidBackup is matched by the errors of Restore for a backup that
+	// is incomplete or fails its checksums.
+	ErrInvalidBackup = errors.New("ERR_INVALID_BACKUP")
+	// ErrLSNTooOld is returned by BackupSince for an LSN older than the latest
+	// backup, or than the latest merge without Options.IncrementalBackups,
+	// which merges may already have dropped records after.
+	ErrLSNTooOld = errors.New("ERR_LSN_TOO_OLD")
+	// ErrInvalidImport is matched by the errors of Import for input it
+	// cannot parse.
+	ErrInvalidImport = errors.New("ERR_INVALID_IMPORT")
+	// ErrUnsupportedVersion is matched by a VersionError.
+	ErrUnsupportedVersion = errors.New("ERR_UNSUPPORTED_VERSION")
+	// ErrChecksumMismatch is matched by the errors of records whose checksum
+	// does not match their content.
+	ErrChecksumMismatch = record.ErrChecksumMismatch
+
+	errExpired = errors.New("expired")
 )
+
+// CorruptionError is returned when a segment holds a record that cannot be
+// read back. It matches ErrCorrupted with errors.Is.
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d: %v", ErrCorrupted, e.Path, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() []error {
+	return []error{ErrCorrupted, e.Err}
+}
+
+// VersionError is returned when a segment was written in a format version
+// newer than this build can read. It matches ErrUnsupportedVersion with
+// errors.Is.
+type VersionError struct {
+	Path    string
+	Version uint32
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("%s: %s has format version %d, the latest supported is %d", ErrUnsupportedVersion, e.Path, e.Version, formatVersion)
+}
+
+func (e *VersionError) Unwrap() error {
+	return ErrUnsupportedVersion
+}
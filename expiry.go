@@ -0,0 +1,169 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiring is a key with a TTL.
+type expiring struct {
+	key   string
+	at    int64
+	index int
+}
+
+// expiryHeap is a min-heap of keys ordered by expiry time.
+type expiryHeap []*expiring
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiring)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// expiryQueue holds every key of the index that has a TTL, so the sweeper
+// finds the due ones without scanning the index. It is guarded by Daklak.mu.
+type expiryQueue struct {
+	heap expiryHeap
+	keys map[string]*expiring
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{keys: make(map[string]*expiring)}
+}
+
+// set queues key to expire at the given unix millisecond, or unqueues it when
+// at is zero.
+func (q *expiryQueue) set(key string, at int64) {
+	item, ok := q.keys[key]
+	switch {
+	case at == 0:
+		q.remove(key)
+	case ok:
+		item.at = at
+		heap.Fix(&q.heap, item.index)
+	default:
+		item = &expiring{key: key, at: at}
+		q.keys[key] = item
+		heap.Push(&q.heap, item)
+	}
+}
+
+func (q *expiryQueue) remove(key string) {
+	item, ok := q.keys[key]
+	if !ok {
+		return
+	}
+
+	delete(q.keys, key)
+	heap.Remove(&q.heap, item.index)
+}
+
+// due unqueues and returns up to limit keys that expire at or before now.
+func (q *expiryQueue) due(now int64, limit int) []string {
+	var keys []string
+	for len(q.heap) > 0 && len(keys) < limit && q.heap[0].at <= now {
+		item := heap.Pop(&q.heap).(*expiring)
+		delete(q.keys, item.key)
+		keys = append(keys, item.key)
+	}
+
+	return keys
+}
+
+// sweepLoop evicts expired keys every Options.SweepInterval.
+func (d *Daklak) sweepLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.sweep(time.Now()); err != nil {
+			d.logf("daklak: expiry sweep failed: %v", err)
+		}
+	}
+}
+
+// sweep writes a tombstone for up to Options.SweepLimit keys that have
+// expired by now and removes them from the index, so they stop showing up in
+// scans and a merge can reclaim their records.
+func (d *Daklak) sweep(now time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	keys := d.expiries.due(now.UnixMilli(), d.opts.SweepLimit)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ops := make([]op, 0, len(keys))
+	for _, key := range keys {
+		if e, ok := d.keys.Get(key); ok && e.expired(now) {
+			ops = append(ops, newDelete(key))
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	err := d.encode(ops)
+	if err == nil {
+		err = d.writeGroup([]*writeRequest{{ops: ops}})
+	}
+
+	if err != nil {
+		// Leave the keys for the next sweep.
+		for _, o := range ops {
+			if e, ok := d.keys.Get(o.key); ok {
+				d.expiries.set(o.key, e.expiresAt)
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,288 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ExportFormat is an encoding of the keys of a store, see Export.
+type ExportFormat int
+
+const (
+	// ExportJSONL writes a JSON object per line with the fields key, value,
+	// base64 and ttl_ms.
+	ExportJSONL ExportFormat = iota
+	// ExportCSV writes a header row, then a row per key with the columns
+	// key, value, base64 and ttl_ms. Keys and values holding a carriage
+	// return are base64-encoded as well, CSV readers turn \r\n into \n.
+	ExportCSV
+)
+
+var csvHeader = []string{"key", "value", "base64", "ttl_ms"}
+
+// exportEntry is a key as exported. The key and value are base64-encoded
+// when Base64 is set, which Export does when either is not valid UTF-8. TTL
+// is the time the key has left to live in milliseconds, zero when it does
+// not expire.
+type exportEntry struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Base64 bool   `json:"base64,omitempty"`
+	TTL    int64  `json:"ttl_ms,omitempty"`
+}
+
+// base64 returns e with its key and value base64-encoded.
+func (e exportEntry) base64() exportEntry {
+	e.Key = base64.StdEncoding.EncodeToString([]byte(e.Key))
+	e.Value = base64.StdEncoding.EncodeToString([]byte(e.Value))
+	e.Base64 = true
+	return e
+}
+
+// Export writes every live key of the store to w in format, along with its
+// value and the time it has left to live. The keys are those of a single
+// point in time; reads and writes continue while it runs.
+func (d *Daklak) Export(w io.Writer, format ExportFormat) error {
+	bw := bufio.NewWriter(w)
+	ew, err := newEntryWriter(bw, format)
+	if err != nil {
+		return err
+	}
+
+	snap, err := d.snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.close()
+
+	keys, err := snap.replay(snap.lsn)
+	if err != nil {
+		return err
+	}
+
+	err = snap.live(keys, func(key string, value []byte, expiresAt int64) error {
+		e := exportEntry{Key: key, Value: string(value)}
+		if !utf8.ValidString(e.Key) || !utf8.ValidString(e.Value) {
+			e = e.base64()
+		}
+
+		if expiresAt != 0 {
+			// A key about to expire still has some time left.
+			e.TTL = max(expiresAt-time.Now().UnixMilli(), 1)
+		}
+
+		return ew.write(e)
+	})
+	if err == nil {
+		err = ew.flush()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Import writes the keys read from r in format, as written by Export, to the
+// store. The keys are written in batches; when Import fails, the batches
+// before the error stay written.
+func (d *Daklak) Import(r io.Reader, format ExportFormat) error {
+	er, err := newEntryReader(bufio.NewReader(r), format)
+	if err != nil {
+		return err
+	}
+
+	b := NewBatch()
+	for {
+		e, err := er.read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		key, value := []byte(e.Key), []byte(e.Value)
+		if e.Base64 {
+			if key, err = base64.StdEncoding.DecodeString(e.Key); err == nil {
+				value, err = base64.StdEncoding.DecodeString(e.Value)
+			}
+
+			if err != nil {
+				return fmt.Errorf("%w: key %q: %v", ErrInvalidImport, e.Key, err)
+			}
+		}
+
+		switch {
+		case e.TTL < 0:
+			return fmt.Errorf("%w: key %q: negative ttl_ms %d", ErrInvalidImport, e.Key, e.TTL)
+		case e.TTL > 0:
+			b.SetEx(string(key), value, time.Duration(e.TTL)*time.Millisecond)
+		default:
+			b.Set(string(key), value)
+		}
+
+		if b.Len() == importBatchSize {
+			if err = d.Write(b); err != nil {
+				return err
+			}
+
+			b.Reset()
+		}
+	}
+
+	return d.Write(b)
+}
+
+// entryWriter writes entries in an ExportFormat.
+type entryWriter interface {
+	write(e exportEntry) error
+	flush() error
+}
+
+// entryReader reads entries in an ExportFormat. read returns io.EOF after the
+// last one.
+type entryReader interface {
+	read() (exportEntry, error)
+}
+
+func newEntryWriter(w io.Writer, format ExportFormat) (entryWriter, error) {
+	switch format {
+	case ExportJSONL:
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return jsonlWriter{enc}, nil
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		return csvWriter{cw}, cw.Write(csvHeader)
+	}
+
+	return nil, fmt.Errorf("unknown export format %d", format)
+}
+
+func newEntryReader(r io.Reader, format ExportFormat) (entryReader, error) {
+	switch format {
+	case ExportJSONL:
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		return &jsonlReader{dec: dec}, nil
+	case ExportCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		header, err := cr.Read()
+		if (err != nil && err != io.EOF) || (err == nil && !slices.Equal(header, csvHeader)) {
+			return nil, fmt.Errorf("%w: the header is not %v", ErrInvalidImport, csvHeader)
+		}
+
+		return csvReader{cr}, nil
+	}
+
+	return nil, fmt.Errorf("unknown export format %d", format)
+}
+
+type jsonlWriter struct {
+	enc *json.Encoder
+}
+
+func (w jsonlWriter) write(e exportEntry) error {
+	return w.enc.Encode(e)
+}
+
+func (jsonlWriter) flush() error {
+	return nil
+}
+
+type jsonlReader struct {
+	dec  *json.Decoder
+	line int
+}
+
+func (r *jsonlReader) read() (exportEntry, error) {
+	r.line++
+	var e exportEntry
+	err := r.dec.Decode(&e)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: line %d: %v", ErrInvalidImport, r.line, err)
+	}
+
+	return e, err
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (w csvWriter) write(e exportEntry) error {
+	if !e.Base64 && (strings.Contains(e.Key, "\r") || strings.Contains(e.Value, "\r")) {
+		e = e.base64()
+	}
+
+	ttl := ""
+	if e.TTL != 0 {
+		ttl = strconv.FormatInt(e.TTL, 10)
+	}
+
+	return w.w.Write([]string{e.Key, e.Value, strconv.FormatBool(e.Base64), ttl})
+}
+
+func (w csvWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type csvReader struct {
+	r *csv.Reader
+}
+
+func (r csvReader) read() (exportEntry, error) {
+	row, err := r.r.Read()
+	if err == io.EOF {
+		return exportEntry{}, err
+	}
+
+	if err != nil {
+		return exportEntry{}, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	e := exportEntry{Key: row[0], Value: row[1]}
+	if e.Base64, err = strconv.ParseBool(row[2]); err == nil && row[3] != "" {
+		e.TTL, err = strconv.ParseInt(row[3], 10, 64)
+	}
+
+	if err != nil {
+		line, _ := r.r.FieldPos(0)
+		return exportEntry{}, fmt.Errorf("%w: line %d: %v", ErrInvalidImport, line, err)
+	}
+
+	return e, nil
+}
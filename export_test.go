@@ -0,0 +1,84 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	opts := testOptions()
+	opts.ValueThreshold = 300
+	d := openTest(t, t.TempDir(), opts)
+	defer d.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key, value := testKey(i), fmt.Sprint("v,\"\n", i)
+		switch {
+		case i%10 == 0:
+			key, value = key+"\xff", string([]byte{0, 0xfe, byte(i)})
+		case i%11 == 0:
+			key, value = key+"\r\n", fmt.Sprint("line\r\n", i)
+		case i%13 == 0:
+			value = strings.Repeat("x", 500)
+		}
+
+		if i%7 == 0 {
+			require.NoError(t, d.SetEx(key, []byte(value), time.Hour))
+		} else {
+			require.NoError(t, d.Set(key, []byte(value)))
+		}
+		want[key] = value
+	}
+	require.NoError(t, d.SetEx("gone", []byte("x"), time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+
+	for _, format := range []ExportFormat{ExportJSONL, ExportCSV} {
+		var buf bytes.Buffer
+		require.NoError(t, d.Export(&buf, format))
+
+		r := openTest(t, t.TempDir(), testOptions())
+		require.NoError(t, r.Import(&buf, format))
+		requireValues(t, r, want)
+
+		ttl, err := r.TTL(testKey(7))
+		require.NoError(t, err)
+		require.Greater(t, ttl, 59*time.Minute)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	d := openTest(t, t.TempDir(), testOptions())
+	defer d.Close()
+
+	err := d.Import(strings.NewReader("{\"key\":1}\n"), ExportJSONL)
+	require.ErrorIs(t, err, ErrInvalidImport)
+	err = d.Import(strings.NewReader("a,b\n"), ExportCSV)
+	require.ErrorIs(t, err, ErrInvalidImport)
+	require.NoError(t, d.Import(strings.NewReader(""), ExportCSV))
+}
@@ -21,44 +21,326 @@
 package daklak
 
 import (
+	"bufio"
+	"errors"
+	"hash/crc32"
 	"io"
 	"os"
-	"sync"
+	"time"
 
 	"github.com/phamvinhdat/daklak/record"
 )
 
-func load(f *os.File) (*sync.Map, error) {
-	info, err := f.Stat()
+// load rebuilds the key index by replaying the segments in order, so a
+// record in a later segment overrides the ones before it. Segments with a
+// usable hint file are read from it instead of being scanned. A segment that
+// turns out to be corrupted is handled according to Options.Recovery.
+func (d *Daklak) load(segments []*segment) error {
+	// The LSN of the latest backup is kept as well, a merge may have dropped
+	// the records up to it.
+	lsn, _, err := readBackupLSN(d.path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	mKeys := new(sync.Map)
-	fileSize := info.Size()
-	if fileSize == 0 {
-		return mKeys, nil
+	keep, err := d.retainedSince()
+	if err != nil {
+		return err
+	}
+
+	var (
+		keys        = newKeydir(d.opts.Index)
+		reclaimable int64
+	)
+	for _, seg := range segments {
+		entries, dead, err := segmentEntries(d.path, seg, d.opts.KeyProvider)
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) {
+			err = d.recover(seg, corruption)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		reclaimable += dead
+		for _, h := range entries {
+			lsn = max(lsn, h.lsn)
+			reclaimable += apply(keys, seg.id, h)
+			if h.tombstone && h.lsn > keep {
+				// Merges keep it for the next incremental backup.
+				reclaimable -= h.size
+			}
+		}
+	}
+
+	// Expired keys are only dropped once every segment is replayed, since a
+	// later record may have changed their expiry.
+	var (
+		now      = time.Now()
+		expired  []string
+		expiries = newExpiryQueue()
+	)
+	keys.Iterate(func(key string, e entry) bool {
+		if e.expired(now) {
+			expired = append(expired, key)
+			reclaimable += e.size
+			return true
+		}
+
+		expiries.set(key, e.expiresAt)
+		return true
+	})
+
+	for _, key := range expired {
+		keys.Delete(key)
+	}
+
+	d.keys = keys
+	d.expiries = expiries
+	d.lsn = lsn
+	d.lastLSN.Store(lsn)
+	d.reclaimable.Store(reclaimable)
+	return nil
+}
+
+// apply stores the record described by h in keys, or removes the key when the
+// record is a tombstone, and returns the bytes it made reclaimable.
+func apply(keys keydir, id uint32, h hintEntry) int64 {
+	var reclaimable int64
+	if h.expire {
+		if cur, ok := keys.Get(h.key); ok {
+			cur.expiresAt = h.expiresAt
+			cur.lsn = h.lsn
+			keys.Put(h.key, cur)
+		}
+
+		return h.size
+	}
+
+	if h.tombstone {
+		if old, loaded := keys.Delete(h.key); loaded {
+			reclaimable += old.size
+		}
+
+		return reclaimable + h.size
+	}
+
+	if old, loaded := keys.Put(h.key, h.entry(id)); loaded {
+		reclaimable += old.size
+	}
+
+	return reclaimable
+}
+
+// segmentEntries returns the last record of every key in seg, taking what it
+// can from the hint file and scanning the rest of the segment. It also returns
+// the bytes of the records shadowed by a later record of the same key.
+// When the segment is corrupted it returns what it could read before the bad
+// record together with a *CorruptionError.
+func segmentEntries(dir string, seg *segment, keys record.KeyProvider) ([]hintEntry, int64, error) {
+	var (
+		entries   []hintEntry
+		start     = seg.start
+		positions = make(map[string]int)
+	)
+
+	hint, covered, err := readHint(dir, seg.id, keys)
+	if err == nil && covered <= seg.size {
+		entries = hint
+		start = covered
+		seg.hinted = covered == seg.size
+		for i, h := range entries {
+			positions[h.key] = i
+		}
 	}
 
-	for {
-		r := &record.Record{}
-		if err := r.FromReader(f); err != nil {
-			if err != io.EOF {
-				return nil, err
+	add := func(h hintEntry) {
+		if i, ok := positions[h.key]; ok {
+			switch {
+			case !h.expire || entries[i].expire:
+				entries[i] = h
+			case !entries[i].tombstone:
+				// Fold the new expiry into the record it applies to.
+				entries[i].expiresAt = h.expiresAt
+				entries[i].lsn = h.lsn
 			}
 
-			break
+			return
 		}
 
-		if !r.Valid() { // delete tombstone or expiated
-			lastOffset += r.Size()
-			mKeys.Delete(r.Key)
-			continue
+		positions[h.key] = len(entries)
+		entries = append(entries, h)
+	}
+
+	end, err := seg.size, error(nil)
+	if start < seg.size {
+		var batch batchReader
+		err = scanSegment(seg, keys, start, seg.size, func(r *record.Record, raw []byte, offset int64) error {
+			switch {
+			case r.Batch:
+				batch.add(r, raw, offset)
+			case r.Header.Type == record.TypeBatchCommit:
+				for _, h := range batch.commit(r) {
+					add(h)
+				}
+			default:
+				batch.reset()
+				add(newHintEntry(r, offset))
+			}
+
+			return nil
+		})
+
+		var corruption *CorruptionError
+		if errors.As(err, &corruption) {
+			end = corruption.Offset
+		} else if err != nil {
+			return nil, 0, err
 		}
+	}
+
+	dead := end - seg.start
+	for _, h := range entries {
+		dead -= h.size
+	}
+
+	return entries, dead, err
+}
+
+// scanSegment calls fn with every record of seg between offsets start and
+// end, along with the offset of the record. A record that is cut short, fails
+// its checksum or cannot be decoded stops the scan with a *CorruptionError.
+func scanSegment(seg *segment, keys record.KeyProvider, start, end int64, fn func(r *record.Record, raw []byte, offset int64) error) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return scanRecords(f, seg.path, seg.format(), keys, start, end, fn)
+}
+
+// scanRecords is scanSegment for the file at path, read through f.
+func scanRecords(f io.ReaderAt, path string, format record.Format, keys record.KeyProvider, start, end int64, fn func(r *record.Record, raw []byte, offset int64) error) error {
+	var (
+		offset = start
+		reader = bufio.NewReader(io.NewSectionReader(f, start, end-start))
+	)
+	for offset < end {
+		r, raw, err := readRecord(reader, end-offset, format, keys)
+		if err != nil {
+			if isCorruption(err) {
+				return &CorruptionError{Path: path, Offset: offset, Err: err}
+			}
+
+			return err
+		}
+
+		if err := fn(r, raw, offset); err != nil {
+			return err
+		}
+
+		offset += r.Size()
+	}
+
+	return nil
+}
+
+// readRecord reads the next record from reader, which has remaining bytes
+// left in its segment. It also returns the record as written.
+func readRecord(reader io.Reader, remaining int64, f record.Format, keys record.KeyProvider) (*record.Record, []byte, error) {
+	header := make([]byte, f.HeaderSize())
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+
+	h, err := record.NewHeaderFormat(header, f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := f.HeaderSize() + h.BodySize()
+	if size > remaining {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+
+	b := make([]byte, size)
+	copy(b, header)
+	if _, err = io.ReadFull(reader, b[len(header):]); err != nil {
+		return nil, nil, err
+	}
+
+	if err = record.Verify(b, f); err != nil {
+		return nil, nil, err
+	}
+
+	r := &record.Record{}
+	if err = r.UnmarshalFormat(b, f, keys); err != nil {
+		return nil, nil, err
+	}
+
+	return r, b, nil
+}
+
+// batchReader holds the batch records read from a segment until their
+// commit record shows up.
+type batchReader struct {
+	entries []hintEntry
+	raw     [][]byte
+}
+
+func (b *batchReader) add(r *record.Record, raw []byte, offset int64) {
+	b.entries = append(b.entries, newHintEntry(r, offset))
+	b.raw = append(b.raw, raw)
+}
+
+// commit returns the entries committed by the commit record r. A batch is
+// written contiguously, so they are the records right before r; anything
+// older is left over from a batch that never committed.
+func (b *batchReader) commit(r *record.Record) []hintEntry {
+	defer b.reset()
+
+	return b.entries[len(b.entries)-committed(b.raw, r):]
+}
+
+// committed returns how many of the records in raw, as written, the commit
+// record r commits.
+func committed(raw [][]byte, r *record.Record) int {
+	count, checksum, ok := r.BatchCommit()
+	if !ok || int(count) > len(raw) {
+		return 0
+	}
+
+	sum := uint32(0)
+	for _, rec := range raw[len(raw)-int(count):] {
+		sum = crc32.Update(sum, crcTable, rec)
+	}
+
+	if sum != checksum {
+		return 0
+	}
+
+	return int(count)
+}
+
+func (b *batchReader) reset() {
+	b.entries = nil
+	b.raw = nil
+}
+
+func isCorruption(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrChecksumMismatch) {
+		return true
+	}
 
-		mKeys.Store(r.Key, lastOffset)
-		lastOffset += r.Size()
+	// Records that passed their checksum but do not decrypt point at the
+	// keys, not at the data.
+	if errors.Is(err, record.ErrUnknownKey) || errors.Is(err, record.ErrEncrypted) ||
+		errors.Is(err, record.ErrDecryptionFailed) {
+		return false
 	}
 
-	return mKeys, nil
+	var pathErr *os.PathError
+	return !errors.As(err, &pathErr)
 }
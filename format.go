@@ -0,0 +1,117 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// Segment format versions. Files written before segments had a header are
+// version 0 and are read as such; new segments are always written in
+// formatVersion.
+const (
+	formatLegacy = 0
+	// formatV1 added the segment header.
+	formatV1 = 1
+	// formatV2 checksums whole records with CRC32C.
+	formatV2      = 2
+	formatVersion = formatV2
+
+	segmentHeaderSize = 32
+
+	// segmentFlags are the segment header flags this build knows. None are
+	// defined yet.
+	segmentFlags = 0
+)
+
+var (
+	segmentMagic = []byte("DAKLAK\x00\x01")
+
+	errHeaderCorrupted = errors.New("segment header corrupted")
+)
+
+// segmentHeader starts every segment file.
+//
+// Layout: magic (8), version (4), flags (4), creation time in unix millis
+// (8), reserved (4) and a CRC32C (4) of everything before it. flags is for the
+// options a segment is created with that change how its records are read.
+// Records describe themselves so far, so no flag is set, and a segment with a
+// flag outside segmentFlags is refused rather than misread.
+type segmentHeader struct {
+	version uint32
+	flags   uint32
+	created int64
+}
+
+func newSegmentHeader() segmentHeader {
+	return segmentHeader{
+		version: formatVersion,
+		created: time.Now().UnixMilli(),
+	}
+}
+
+func (h segmentHeader) marshal() []byte {
+	b := make([]byte, segmentHeaderSize)
+	copy(b, segmentMagic)
+	binary.LittleEndian.PutUint32(b[8:], h.version)
+	binary.LittleEndian.PutUint32(b[8+4:], h.flags)
+	binary.LittleEndian.PutUint64(b[8+4+4:], uint64(h.created))
+	binary.LittleEndian.PutUint32(b[segmentHeaderSize-4:], crc32.Checksum(b[:segmentHeaderSize-4], crcTable))
+	return b
+}
+
+func (h *segmentHeader) unmarshal(b []byte) error {
+	if len(b) < segmentHeaderSize {
+		return errHeaderCorrupted
+	}
+
+	if crc32.Checksum(b[:segmentHeaderSize-4], crcTable) != binary.LittleEndian.Uint32(b[segmentHeaderSize-4:]) {
+		return errHeaderCorrupted
+	}
+
+	h.version = binary.LittleEndian.Uint32(b[8:])
+	h.flags = binary.LittleEndian.Uint32(b[8+4:])
+	h.created = int64(binary.LittleEndian.Uint64(b[8+4+4:]))
+	return nil
+}
+
+// hasMagic reports whether b, the first bytes of a segment file, can be the
+// start of a segment header. No legacy record starts with the magic.
+func hasMagic(b []byte) bool {
+	n := min(len(b), len(segmentMagic))
+	return bytes.Equal(b[:n], segmentMagic[:n])
+}
+
+// recordFormat returns the layout of the records of a segment of the given
+// version.
+func recordFormat(version uint32) record.Format {
+	if version < formatV2 {
+		return record.FormatMD5
+	}
+
+	return record.FormatCRC32C
+}
@@ -0,0 +1,161 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyRecord encodes a record the way stores were written before segments
+// had a header. An empty value is a delete.
+func legacyRecord(key, value string, expiresAt time.Time) []byte {
+	var encoded []byte
+	sum := [md5.Size]byte{}
+	if value != "" {
+		encoded = snappy.Encode(nil, []byte(value))
+		sum = md5.Sum(encoded)
+	}
+
+	b := make([]byte, record.LegacyHeaderSize)
+	binary.LittleEndian.PutUint32(b[1:], uint32(len(key)))
+	binary.LittleEndian.PutUint32(b[1+4:], uint32(len(encoded)))
+	copy(b[1+4+4:], sum[:])
+	if !expiresAt.IsZero() {
+		b[0] = byte(record.TypeTTL)
+		b = binary.LittleEndian.AppendUint64(b, uint64(expiresAt.UnixMilli()))
+	}
+
+	b = append(b, key...)
+	return append(b, encoded...)
+}
+
+// legacyStore writes a store in the legacy format to dir and returns what it
+// holds.
+func legacyStore(t *testing.T, dir string) map[string]string {
+	var (
+		b    []byte
+		want = make(map[string]string)
+	)
+	for i := 0; i < 50; i++ {
+		b = append(b, legacyRecord(testKey(i), "old", time.Time{})...)
+		b = append(b, legacyRecord(testKey(i), testKey(i), time.Time{})...)
+		want[testKey(i)] = testKey(i)
+	}
+	b = append(b, legacyRecord(testKey(3), "", time.Time{})...)
+	delete(want, testKey(3))
+	b = append(b, legacyRecord("ttl", "v", time.Now().Add(time.Hour))...)
+	want["ttl"] = "v"
+	b = append(b, legacyRecord("expired", "v", time.Now().Add(-time.Hour))...)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dataFile), b, 0644))
+	return want
+}
+
+func TestLegacyOpen(t *testing.T) {
+	dir := t.TempDir()
+	want := legacyStore(t, dir)
+
+	d := openTest(t, dir, testOptions())
+	requireValues(t, d, want)
+	ttl, err := d.TTL("ttl")
+	require.NoError(t, err)
+	require.Greater(t, ttl, 59*time.Minute)
+
+	require.NoError(t, d.Set("new", []byte("1")))
+	want["new"] = "1"
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, testOptions())
+	requireValues(t, d, want)
+	require.NoError(t, d.Merge())
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, testOptions())
+	defer d.Close()
+	requireValues(t, d, want)
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	want := legacyStore(t, dir)
+	require.NoError(t, Migrate(dir))
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.True(t, hasMagic(b), path)
+	}
+
+	d := openTest(t, dir, testOptions())
+	defer d.Close()
+	requireValues(t, d, want)
+}
+
+// rewriteHeader changes the header of the first segment of the store in dir.
+func rewriteHeader(t *testing.T, dir string, fn func(h *segmentHeader)) {
+	path := filepath.Join(dir, segmentName(0))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var h segmentHeader
+	require.NoError(t, h.unmarshal(b))
+	fn(&h)
+	copy(b, h.marshal())
+	require.NoError(t, os.WriteFile(path, b, 0644))
+}
+
+func TestSegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("a", []byte("1")))
+	require.NoError(t, d.Close())
+
+	rewriteHeader(t, dir, func(h *segmentHeader) { h.version = formatVersion + 1 })
+	_, err := NewDaklakWithOptions(dir, testOptions())
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	rewriteHeader(t, dir, func(h *segmentHeader) {
+		h.version = formatVersion
+		h.flags = 1 << 31
+	})
+	_, err = NewDaklakWithOptions(dir, testOptions())
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	// A header that fails its checksum is corrupted.
+	path := filepath.Join(dir, segmentName(0))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[8+4+4] ^= 1
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	_, err = NewDaklakWithOptions(dir, testOptions())
+	require.ErrorIs(t, err, ErrCorrupted)
+}
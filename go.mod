@@ -5,13 +5,13 @@ go 1.21
 require (
 	github.com/golang/snappy v0.0.4
 	github.com/stretchr/testify v1.8.4
+	github.com/tidwall/btree v1.7.0
+	github.com/tidwall/match v1.1.1
 	github.com/tidwall/redcon v1.6.2
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/tidwall/btree v1.7.0 // indirect
-	github.com/tidwall/match v1.1.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,281 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+const (
+	hintEntryHeaderSize = 1 + 4 + 8 + 8 + 8
+	hintFooterSize      = 8 + 4 + 4
+)
+
+// Flags of a hint entry.
+const (
+	hintTombstone = 1 << iota
+	hintExpire
+	// hintPointer is set when a value pointer follows the key.
+	hintPointer
+	// hintLSN is set when the LSN follows the key and value pointer.
+	hintLSN
+)
+
+var (
+	errHintCorrupted = errors.New("hint file corrupted")
+	crcTable         = crc32.MakeTable(crc32.Castagnoli)
+
+	// sealedHintMagic starts the hint files of encrypted stores, the rest of
+	// the file is the plain layout sealed with record.Seal.
+	sealedHintMagic = []byte("DAKHINT\x01")
+)
+
+// hintEntry is the last record of a key in a segment, as kept in the
+// segment's hint file. An expire entry only changes the expiry of the key's
+// record in an earlier segment.
+type hintEntry struct {
+	key       string
+	tombstone bool
+	expire    bool
+	offset    int64
+	size      int64
+	expiresAt int64
+	value     *record.ValuePointer
+	lsn       uint64
+}
+
+func newHintEntry(r *record.Record, offset int64) hintEntry {
+	h := hintEntry{
+		key:       r.Key,
+		tombstone: r.Tombstone(),
+		expire:    r.Header.Type == record.TypeExpire,
+		offset:    offset,
+		size:      r.Size(),
+		value:     r.Pointer,
+		lsn:       r.LSN,
+	}
+
+	if r.ExpiatedAt != nil {
+		h.expiresAt = r.ExpiatedAt.UnixMilli()
+	}
+
+	return h
+}
+
+func (h hintEntry) entry(id uint32) entry {
+	return entry{
+		segment:   id,
+		offset:    h.offset,
+		size:      h.size,
+		expiresAt: h.expiresAt,
+		value:     h.value,
+		lsn:       h.lsn,
+	}
+}
+
+func hintName(id uint32) string {
+	return fmt.Sprintf("%09d%s", id, hintExt)
+}
+
+// writeHint writes the hint file of a segment. covered is the size of the
+// segment the entries were read from; records appended after it are not in
+// the hint and have to be scanned.
+//
+// Layout: entries, then covered (8), entry count (4) and a CRC32C (4) of
+// everything before it. An entry is flags (1), key length (4), offset (8),
+// size (8), expiry in unix millis (8), the key and, with hintPointer and
+// hintLSN, the value pointer and the LSN. Hints hold the keys in
+// the clear, so they are sealed when keys is not nil.
+func writeHint(dir string, id uint32, covered int64, entries []hintEntry, keys record.KeyProvider, mode os.FileMode) error {
+	var buf bytes.Buffer
+	header := make([]byte, hintEntryHeaderSize)
+	for _, h := range entries {
+		header[0] = 0
+		if h.tombstone {
+			header[0] |= hintTombstone
+		}
+
+		if h.expire {
+			header[0] |= hintExpire
+		}
+
+		if h.value != nil {
+			header[0] |= hintPointer
+		}
+
+		if h.lsn != 0 {
+			header[0] |= hintLSN
+		}
+
+		binary.LittleEndian.PutUint32(header[1:], uint32(len(h.key)))
+		binary.LittleEndian.PutUint64(header[1+4:], uint64(h.offset))
+		binary.LittleEndian.PutUint64(header[1+4+8:], uint64(h.size))
+		binary.LittleEndian.PutUint64(header[1+4+8+8:], uint64(h.expiresAt))
+		buf.Write(header)
+		buf.WriteString(h.key)
+		if h.value != nil {
+			buf.Write(h.value.Marshal())
+		}
+
+		if h.lsn != 0 {
+			buf.Write(binary.LittleEndian.AppendUint64(nil, h.lsn))
+		}
+	}
+
+	footer := make([]byte, hintFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(covered))
+	binary.LittleEndian.PutUint32(footer[8:], uint32(len(entries)))
+	buf.Write(footer[:8+4])
+	binary.LittleEndian.PutUint32(footer[8+4:], crc32.Checksum(buf.Bytes(), crcTable))
+	buf.Write(footer[8+4:])
+
+	b := buf.Bytes()
+	if keys != nil {
+		sealed, err := record.Seal(keys, b, sealedHintMagic)
+		if err != nil {
+			return err
+		}
+
+		b = append(append([]byte(nil), sealedHintMagic...), sealed...)
+	}
+
+	path := filepath.Join(dir, hintName(id))
+	f, err := os.OpenFile(path+tmpExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(path + tmpExt)
+		return err
+	}
+
+	return os.Rename(path+tmpExt, path)
+}
+
+// readHint reads the hint file of a segment and returns its entries and the
+// size of the segment they cover.
+func readHint(dir string, id uint32, keys record.KeyProvider) ([]hintEntry, int64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, hintName(id)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if bytes.HasPrefix(b, sealedHintMagic) {
+		if b, err = record.Open(keys, b[len(sealedHintMagic):], sealedHintMagic); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if len(b) < hintFooterSize {
+		return nil, 0, errHintCorrupted
+	}
+
+	body := b[:len(b)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return nil, 0, errHintCorrupted
+	}
+
+	footer := b[len(b)-hintFooterSize:]
+	covered := int64(binary.LittleEndian.Uint64(footer))
+	entries := make([]hintEntry, 0, binary.LittleEndian.Uint32(footer[8:]))
+	b = b[:len(b)-hintFooterSize]
+	for len(b) > 0 {
+		if len(b) < hintEntryHeaderSize {
+			return nil, 0, errHintCorrupted
+		}
+
+		keyLen := int(binary.LittleEndian.Uint32(b[1:]))
+		size := hintEntryHeaderSize + keyLen
+		if b[0]&hintPointer != 0 {
+			size += record.PointerSize
+		}
+
+		if b[0]&hintLSN != 0 {
+			size += 8
+		}
+
+		if len(b) < size {
+			return nil, 0, errHintCorrupted
+		}
+
+		var (
+			value *record.ValuePointer
+			lsn   uint64
+			tail  = b[hintEntryHeaderSize+keyLen : size]
+		)
+		if b[0]&hintPointer != 0 {
+			value = &record.ValuePointer{}
+			if err = value.Unmarshal(tail[:record.PointerSize]); err != nil {
+				return nil, 0, errHintCorrupted
+			}
+
+			tail = tail[record.PointerSize:]
+		}
+
+		if b[0]&hintLSN != 0 {
+			lsn = binary.LittleEndian.Uint64(tail)
+		}
+
+		entries = append(entries, hintEntry{
+			key:       string(b[hintEntryHeaderSize : hintEntryHeaderSize+keyLen]),
+			tombstone: b[0]&hintTombstone != 0,
+			expire:    b[0]&hintExpire != 0,
+			offset:    int64(binary.LittleEndian.Uint64(b[1+4:])),
+			size:      int64(binary.LittleEndian.Uint64(b[1+4+8:])),
+			expiresAt: int64(binary.LittleEndian.Uint64(b[1+4+8+8:])),
+			value:     value,
+			lsn:       lsn,
+		})
+		b = b[size:]
+	}
+
+	if len(entries) != cap(entries) {
+		return nil, 0, errHintCorrupted
+	}
+
+	return entries, covered, nil
+}
+
+func removeHint(dir string, id uint32) error {
+	err := os.Remove(filepath.Join(dir, hintName(id)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
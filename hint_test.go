@@ -0,0 +1,119 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hintStore fills a store over two opens, so every segment has a hint file,
+// and returns what it should hold and the hint files after the first open.
+func hintStore(t *testing.T, dir string) (map[string]string, map[string][]byte) {
+	t.Helper()
+	d := openTest(t, dir, mergeOptions())
+	want := mergeStore(t, d)
+	require.NoError(t, d.Close())
+
+	first := map[string][]byte{}
+	for name, b := range storeFiles(t, dir) {
+		if filepath.Ext(name) == hintExt {
+			first[name] = b
+		}
+	}
+
+	d = openTest(t, dir, mergeOptions())
+	require.NoError(t, d.Set(testKey(1), []byte("new")))
+	require.NoError(t, d.Delete(testKey(2)))
+	require.NoError(t, d.Expire(testKey(4), time.Hour))
+	b := NewBatch()
+	b.Set("batch", []byte("value"))
+	b.Delete(testKey(5))
+	require.NoError(t, d.Write(b))
+	require.NoError(t, d.Close())
+
+	want[testKey(1)] = "new"
+	want["batch"] = "value"
+	delete(want, testKey(2))
+	delete(want, testKey(5))
+	return want, first
+}
+
+func TestHintFallback(t *testing.T) {
+	tests := map[string]func(b []byte) []byte{
+		"missing":   func([]byte) []byte { return nil },
+		"garbage":   func([]byte) []byte { return []byte("garbage-garbage-garbage") },
+		"truncated": func(b []byte) []byte { return b[:len(b)-1] },
+		"bit flip": func(b []byte) []byte {
+			b[len(b)/2] ^= 1
+			return b
+		},
+	}
+
+	for name, corrupt := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			want, _ := hintStore(t, dir)
+			for name, b := range storeFiles(t, dir) {
+				if filepath.Ext(name) != hintExt {
+					continue
+				}
+
+				path := filepath.Join(dir, name)
+				if b = corrupt(b); b == nil {
+					require.NoError(t, os.Remove(path))
+					continue
+				}
+
+				require.NoError(t, os.WriteFile(path, b, 0644))
+			}
+
+			d := openTest(t, dir, mergeOptions())
+			requireValues(t, d, want)
+			ttl, err := d.TTL(testKey(4))
+			require.NoError(t, err)
+			require.Greater(t, ttl, time.Minute)
+			require.NoError(t, d.Close())
+
+			d = openTest(t, dir, mergeOptions())
+			defer d.Close()
+			requireValues(t, d, want)
+		})
+	}
+}
+
+func TestHintStale(t *testing.T) {
+	dir := t.TempDir()
+	want, first := hintStore(t, dir)
+	for name, b := range first {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), b, 0644))
+	}
+
+	d := openTest(t, dir, mergeOptions())
+	defer d.Close()
+	requireValues(t, d, want)
+	ttl, err := d.TTL(testKey(4))
+	require.NoError(t, err)
+	require.Greater(t, ttl, time.Minute)
+}
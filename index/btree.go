@@ -0,0 +1,86 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package index
+
+import (
+	"github.com/tidwall/btree"
+)
+
+type item[V any] struct {
+	key string
+	v   V
+}
+
+// BTree is an ordered Indexer backed by a B-tree.
+type BTree[V any] struct {
+	tree *btree.BTreeG[item[V]]
+}
+
+func NewBTree[V any]() *BTree[V] {
+	return &BTree[V]{
+		tree: btree.NewBTreeG(func(a, b item[V]) bool { return a.key < b.key }),
+	}
+}
+
+func (b *BTree[V]) Get(key string) (V, bool) {
+	it, ok := b.tree.Get(item[V]{key: key})
+	return it.v, ok
+}
+
+func (b *BTree[V]) Put(key string, v V) (V, bool) {
+	old, replaced := b.tree.Set(item[V]{key: key, v: v})
+	return old.v, replaced
+}
+
+func (b *BTree[V]) Delete(key string) (V, bool) {
+	old, deleted := b.tree.Delete(item[V]{key: key})
+	return old.v, deleted
+}
+
+func (b *BTree[V]) Len() int {
+	return b.tree.Len()
+}
+
+func (b *BTree[V]) Iterate(fn func(key string, v V) bool) {
+	// Scan holds the lock of the tree it walks, a copy-on-write copy keeps
+	// fn from deadlocking when it writes.
+	b.tree.Copy().Scan(func(it item[V]) bool {
+		return fn(it.key, it.v)
+	})
+}
+
+func (b *BTree[V]) Ascend(pivot string, fn func(key string, v V) bool) {
+	b.tree.Ascend(item[V]{key: pivot}, func(it item[V]) bool {
+		return fn(it.key, it.v)
+	})
+}
+
+func (b *BTree[V]) Descend(pivot string, fn func(key string, v V) bool) {
+	b.tree.Descend(item[V]{key: pivot}, func(it item[V]) bool {
+		return fn(it.key, it.v)
+	})
+}
+
+func (b *BTree[V]) Reverse(fn func(key string, v V) bool) {
+	b.tree.Reverse(func(it item[V]) bool {
+		return fn(it.key, it.v)
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package index
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Hash is an Indexer backed by a hash map. It is the fastest for point
+// lookups but does not keep its keys in order.
+type Hash[V any] struct {
+	m     sync.Map
+	count atomic.Int64
+}
+
+func NewHash[V any]() *Hash[V] {
+	return &Hash[V]{}
+}
+
+func (h *Hash[V]) Get(key string) (V, bool) {
+	value, ok := h.m.Load(key)
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	return value.(V), true
+}
+
+func (h *Hash[V]) Put(key string, v V) (V, bool) {
+	old, loaded := h.m.Swap(key, v)
+	if !loaded {
+		h.count.Add(1)
+		var zero V
+		return zero, false
+	}
+
+	return old.(V), true
+}
+
+func (h *Hash[V]) Delete(key string) (V, bool) {
+	old, loaded := h.m.LoadAndDelete(key)
+	if !loaded {
+		var zero V
+		return zero, false
+	}
+
+	h.count.Add(-1)
+	return old.(V), true
+}
+
+func (h *Hash[V]) Len() int {
+	return int(h.count.Load())
+}
+
+func (h *Hash[V]) Iterate(fn func(key string, v V) bool) {
+	h.m.Range(func(key, value any) bool {
+		return fn(key.(string), value.(V))
+	})
+}
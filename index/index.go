@@ -0,0 +1,51 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package index holds the in-memory structures that map keys to the
+// location of their latest record.
+package index
+
+// Indexer maps keys to values. All methods are safe for concurrent use.
+type Indexer[V any] interface {
+	Get(key string) (V, bool)
+	// Put stores v and returns the value it replaced.
+	Put(key string, v V) (V, bool)
+	// Delete removes key and returns its value.
+	Delete(key string) (V, bool)
+	Len() int
+	// Iterate calls fn for every key until fn returns false. Indexes that
+	// implement Ordered iterate in ascending key order, others in no
+	// particular order. fn may modify the index; keys it puts may or may
+	// not be visited.
+	Iterate(fn func(key string, v V) bool)
+}
+
+// Ordered walks keys in order. The callbacks must not modify the index.
+type Ordered[V any] interface {
+	// Ascend calls fn for the keys greater than or equal to pivot in
+	// ascending order until fn returns false.
+	Ascend(pivot string, fn func(key string, v V) bool)
+	// Descend calls fn for the keys less than or equal to pivot in
+	// descending order until fn returns false.
+	Descend(pivot string, fn func(key string, v V) bool)
+	// Reverse calls fn for all keys in descending order until fn returns
+	// false.
+	Reverse(fn func(key string, v V) bool)
+}
@@ -0,0 +1,82 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package index
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func indexes() map[string]Indexer[int] {
+	return map[string]Indexer[int]{
+		"hash":  NewHash[int](),
+		"btree": NewBTree[int](),
+		"radix": NewRadix[int](),
+	}
+}
+
+func TestIterateDeletes(t *testing.T) {
+	for name, ix := range indexes() {
+		t.Run(name, func(t *testing.T) {
+			var want []string
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key-%04d", i)
+				ix.Put(key, i)
+				want = append(want, key)
+			}
+
+			var keys []string
+			ix.Iterate(func(key string, v int) bool {
+				_, ok := ix.Delete(key)
+				require.True(t, ok, key)
+				keys = append(keys, key)
+				return true
+			})
+
+			if _, ok := ix.(Ordered[int]); ok {
+				require.True(t, sort.StringsAreSorted(keys))
+			}
+
+			sort.Strings(keys)
+			require.Equal(t, want, keys)
+			require.Zero(t, ix.Len())
+		})
+	}
+}
+
+func TestIterateStops(t *testing.T) {
+	for name, ix := range indexes() {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 1000; i++ {
+				ix.Put(fmt.Sprintf("key-%04d", i), i)
+			}
+
+			count := 0
+			ix.Iterate(func(string, int) bool {
+				count++
+				return count < 300
+			})
+			require.Equal(t, 300, count)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package index
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// iterateBatch is the number of keys Iterate copies out of a Radix at a time.
+const iterateBatch = 256
+
+// Radix is an ordered Indexer backed by a compressed radix tree. Keys that
+// share a prefix share its bytes, which makes it the most compact choice for
+// large keyspaces with structured keys.
+type Radix[V any] struct {
+	mu    sync.RWMutex
+	root  node[V]
+	count int
+}
+
+// node holds the part of a key that follows its parent. Children are sorted
+// by their first byte, which no two children share.
+type node[V any] struct {
+	prefix   string
+	children []*node[V]
+	leaf     bool
+	v        V
+}
+
+func NewRadix[V any]() *Radix[V] {
+	return &Radix[V]{}
+}
+
+func (n *node[V]) child(c byte) (int, bool) {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].prefix[0] >= c
+	})
+
+	return i, i < len(n.children) && n.children[i].prefix[0] == c
+}
+
+func (r *Radix[V]) Get(key string) (V, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := &r.root
+	for {
+		if key == "" {
+			return n.v, n.leaf
+		}
+
+		i, ok := n.child(key[0])
+		if !ok || !strings.HasPrefix(key, n.children[i].prefix) {
+			var zero V
+			return zero, false
+		}
+
+		n = n.children[i]
+		key = key[len(n.prefix):]
+	}
+}
+
+func (r *Radix[V]) Put(key string, v V) (V, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := &r.root
+	for key != "" {
+		i, ok := n.child(key[0])
+		if !ok {
+			n.children = append(n.children, nil)
+			copy(n.children[i+1:], n.children[i:])
+			n.children[i] = &node[V]{prefix: key}
+			n = n.children[i]
+			break
+		}
+
+		c := n.children[i]
+		l := commonPrefix(key, c.prefix)
+		if l < len(c.prefix) {
+			split := &node[V]{prefix: c.prefix[:l], children: []*node[V]{c}}
+			c.prefix = c.prefix[l:]
+			n.children[i] = split
+			c = split
+		}
+
+		n = c
+		key = key[l:]
+	}
+
+	old, replaced := n.v, n.leaf
+	n.v, n.leaf = v, true
+	if !replaced {
+		r.count++
+	}
+
+	return old, replaced
+}
+
+func (r *Radix[V]) Delete(key string) (V, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var (
+		zero   V
+		parent *node[V]
+		at     int
+	)
+
+	n := &r.root
+	for key != "" {
+		i, ok := n.child(key[0])
+		if !ok || !strings.HasPrefix(key, n.children[i].prefix) {
+			return zero, false
+		}
+
+		parent, at = n, i
+		n = n.children[i]
+		key = key[len(n.prefix):]
+	}
+
+	if !n.leaf {
+		return zero, false
+	}
+
+	old := n.v
+	n.v, n.leaf = zero, false
+	r.count--
+
+	if parent == nil {
+		return old, true
+	}
+
+	switch len(n.children) {
+	case 0:
+		parent.children = append(parent.children[:at], parent.children[at+1:]...)
+		if parent != &r.root && !parent.leaf && len(parent.children) == 1 {
+			parent.mergeChild()
+		}
+	case 1:
+		n.mergeChild()
+	}
+
+	return old, true
+}
+
+// mergeChild folds the only child of n into n.
+func (n *node[V]) mergeChild() {
+	c := n.children[0]
+	n.prefix += c.prefix
+	n.children, n.leaf, n.v = c.children, c.leaf, c.v
+}
+
+func (r *Radix[V]) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.count
+}
+
+// Iterate copies the keys out of the tree iterateBatch at a time and calls
+// fn without holding the lock.
+func (r *Radix[V]) Iterate(fn func(key string, v V) bool) {
+	var (
+		keys   = make([]string, 0, iterateBatch)
+		values = make([]V, 0, iterateBatch)
+		pivot  string
+	)
+	for {
+		keys, values = keys[:0], values[:0]
+		r.mu.RLock()
+		r.root.ascend("", pivot, func(key string, v V) bool {
+			keys = append(keys, key)
+			values = append(values, v)
+			return len(keys) < iterateBatch
+		})
+		r.mu.RUnlock()
+
+		for i, key := range keys {
+			if !fn(key, values[i]) {
+				return
+			}
+		}
+
+		if len(keys) < iterateBatch {
+			return
+		}
+
+		// The smallest key after the last one.
+		pivot = keys[len(keys)-1] + "\x00"
+	}
+}
+
+func (r *Radix[V]) Ascend(pivot string, fn func(key string, v V) bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	r.root.ascend("", pivot, fn)
+}
+
+func (r *Radix[V]) Descend(pivot string, fn func(key string, v V) bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	r.root.descend("", pivot, true, fn)
+}
+
+func (r *Radix[V]) Reverse(fn func(key string, v V) bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	r.root.descend("", "", false, fn)
+}
+
+// ascend walks the subtree of n, whose keys all start with path+n.prefix,
+// in ascending order, skipping the keys less than pivot.
+func (n *node[V]) ascend(path, pivot string, fn func(key string, v V) bool) bool {
+	path += n.prefix
+	switch comparePrefix(path, pivot) {
+	case -1:
+		return true
+	case 1:
+		pivot = ""
+	}
+
+	if n.leaf && path >= pivot && !fn(path, n.v) {
+		return false
+	}
+
+	for _, c := range n.children {
+		if !c.ascend(path, pivot, fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// descend walks the subtree of n in descending order. When bounded, keys
+// greater than pivot are skipped.
+func (n *node[V]) descend(path, pivot string, bounded bool, fn func(key string, v V) bool) bool {
+	path += n.prefix
+	if bounded {
+		switch {
+		case len(path) > len(pivot) && strings.HasPrefix(path, pivot):
+			return true
+		case comparePrefix(path, pivot) == 1:
+			return true
+		case comparePrefix(path, pivot) == -1:
+			bounded = false
+		}
+	}
+
+	for i := len(n.children) - 1; i >= 0; i-- {
+		if !n.children[i].descend(path, pivot, bounded, fn) {
+			return false
+		}
+	}
+
+	return !n.leaf || fn(path, n.v)
+}
+
+// comparePrefix compares path with the prefix of pivot of the same length.
+// Zero means path is a prefix of pivot, or pivot a prefix of path.
+func comparePrefix(path, pivot string) int {
+	l := min(len(path), len(pivot))
+	return strings.Compare(path[:l], pivot[:l])
+}
+
+func commonPrefix(a, b string) int {
+	l := min(len(a), len(b))
+	for i := 0; i < l; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return l
+}
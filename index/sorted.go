@@ -0,0 +1,80 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package index
+
+import (
+	"sort"
+)
+
+// Sorted is a sorted, read-only copy of the keys of an Indexer, for walking
+// an index that does not implement Ordered in key order.
+type Sorted[V any] struct {
+	keys   []string
+	values []V
+}
+
+func NewSorted[V any](ix Indexer[V]) *Sorted[V] {
+	s := &Sorted[V]{}
+	ix.Iterate(func(key string, v V) bool {
+		s.keys = append(s.keys, key)
+		s.values = append(s.values, v)
+		return true
+	})
+
+	sort.Sort(s)
+	return s
+}
+
+func (s *Sorted[V]) Len() int           { return len(s.keys) }
+func (s *Sorted[V]) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s *Sorted[V]) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+func (s *Sorted[V]) Ascend(pivot string, fn func(key string, v V) bool) {
+	for i := sort.SearchStrings(s.keys, pivot); i < len(s.keys); i++ {
+		if !fn(s.keys[i], s.values[i]) {
+			return
+		}
+	}
+}
+
+func (s *Sorted[V]) Descend(pivot string, fn func(key string, v V) bool) {
+	i := sort.SearchStrings(s.keys, pivot)
+	if i == len(s.keys) || s.keys[i] != pivot {
+		i--
+	}
+
+	for ; i >= 0; i-- {
+		if !fn(s.keys[i], s.values[i]) {
+			return
+		}
+	}
+}
+
+func (s *Sorted[V]) Reverse(fn func(key string, v V) bool) {
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if !fn(s.keys[i], s.values[i]) {
+			return
+		}
+	}
+}
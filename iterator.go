@@ -0,0 +1,235 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"strings"
+	"time"
+
+	"github.com/phamvinhdat/daklak/index"
+)
+
+// IteratorOptions restricts the keys an Iterator visits.
+type IteratorOptions struct {
+	// Prefix limits the iterator to the keys starting with it.
+	Prefix string
+	// Start is the inclusive lower bound, empty means unbounded.
+	Start string
+	// End is the exclusive upper bound, empty means unbounded.
+	End string
+	// Reverse walks the keys in descending order.
+	Reverse bool
+}
+
+// Iterator walks the live keys of a store in sorted order. With IndexBTree or
+// IndexRadix it walks the index itself and sees writes made while it runs;
+// with IndexHash it walks a sorted copy of the keys taken by NewIterator.
+//
+// An Iterator is not safe for concurrent use.
+type Iterator struct {
+	d    *Daklak
+	keys index.Ordered[entry]
+	opts IteratorOptions
+
+	// lower is the inclusive lower bound, upper the exclusive upper bound
+	// when hasUpper is set.
+	lower    string
+	upper    string
+	hasUpper bool
+
+	key   string
+	valid bool
+}
+
+// NewIterator returns an iterator positioned at the first key in range, or
+// the last one when opts.Reverse is set.
+func (d *Daklak) NewIterator(opts IteratorOptions) *Iterator {
+	keys, ok := d.keys.(index.Ordered[entry])
+	if !ok {
+		keys = index.NewSorted(d.keys)
+	}
+
+	it := &Iterator{
+		d:     d,
+		keys:  keys,
+		opts:  opts,
+		lower: opts.Start,
+	}
+
+	if opts.Prefix > it.lower {
+		it.lower = opts.Prefix
+	}
+
+	if opts.End != "" {
+		it.upper, it.hasUpper = opts.End, true
+	}
+
+	if next, ok := prefixEnd(opts.Prefix); ok && (!it.hasUpper || next < it.upper) {
+		it.upper, it.hasUpper = next, true
+	}
+
+	it.Rewind()
+	return it
+}
+
+// Rewind moves to the first key in range.
+func (it *Iterator) Rewind() {
+	if it.opts.Reverse {
+		it.backward(it.upper, !it.hasUpper, false)
+		return
+	}
+
+	it.forward(it.lower, false)
+}
+
+// Seek moves to the first key greater than or equal to key, or with Reverse
+// to the last key less than or equal to key.
+func (it *Iterator) Seek(key string) {
+	if it.opts.Reverse {
+		if it.hasUpper && key > it.upper {
+			key = it.upper
+		}
+
+		it.backward(key, false, false)
+		return
+	}
+
+	if key < it.lower {
+		key = it.lower
+	}
+
+	it.forward(key, false)
+}
+
+// Next moves to the next key in iteration order.
+func (it *Iterator) Next() {
+	if !it.valid {
+		return
+	}
+
+	if it.opts.Reverse {
+		it.backward(it.key, false, true)
+		return
+	}
+
+	it.forward(it.key, true)
+}
+
+// Prev moves to the previous key in iteration order.
+func (it *Iterator) Prev() {
+	if !it.valid {
+		return
+	}
+
+	if it.opts.Reverse {
+		it.forward(it.key, true)
+		return
+	}
+
+	it.backward(it.key, false, true)
+}
+
+// Valid reports whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value reads the current value of the key the iterator is positioned at.
+// It returns ErrResourceNotFound if the key was deleted since.
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.valid {
+		return nil, ErrResourceNotFound
+	}
+
+	return it.d.Get(it.key)
+}
+
+// forward moves to the first live key in range from pivot up.
+func (it *Iterator) forward(pivot string, exclusive bool) {
+	it.valid = false
+	now := time.Now()
+	it.keys.Ascend(pivot, func(key string, e entry) bool {
+		switch {
+		case exclusive && key == pivot:
+			return true
+		case it.above(key):
+			return false
+		case key < it.lower || e.expired(now):
+			return true
+		}
+
+		it.key, it.valid = key, true
+		return false
+	})
+}
+
+// backward moves to the last live key in range from pivot down, or from the
+// largest key when unbounded is set.
+func (it *Iterator) backward(pivot string, unbounded, exclusive bool) {
+	it.valid = false
+	now := time.Now()
+	fn := func(key string, e entry) bool {
+		switch {
+		case exclusive && key == pivot:
+			return true
+		case key < it.lower:
+			return false
+		case it.above(key) || e.expired(now):
+			return true
+		}
+
+		it.key, it.valid = key, true
+		return false
+	}
+
+	if unbounded {
+		it.keys.Reverse(fn)
+		return
+	}
+
+	it.keys.Descend(pivot, fn)
+}
+
+func (it *Iterator) above(key string) bool {
+	if it.hasUpper && key >= it.upper {
+		return true
+	}
+
+	return it.opts.Prefix != "" && key > it.opts.Prefix && !strings.HasPrefix(key, it.opts.Prefix)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix. There is none when the prefix is empty or all 0xff.
+func prefixEnd(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+
+	return "", false
+}
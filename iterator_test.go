@@ -0,0 +1,138 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// iteratorKeys are sorted and hold prefixes that end with 0xff bytes.
+var iteratorKeys = []string{
+	"a", "ab", "abc", "b", "b\xff", "b\xff\xff", "b\xff\xffz", "c", "\xff", "\xff\xff",
+}
+
+// inRange returns the keys opts selects in iteration order.
+func inRange(keys []string, opts IteratorOptions) []string {
+	var want []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, opts.Prefix) && key >= opts.Start && (opts.End == "" || key < opts.End) {
+			want = append(want, key)
+		}
+	}
+
+	if opts.Reverse {
+		slices.Reverse(want)
+	}
+
+	return want
+}
+
+func TestIterator(t *testing.T) {
+	ranges := []IteratorOptions{
+		{},
+		{Prefix: "a"},
+		{Prefix: "ab"},
+		{Prefix: "b\xff"},
+		{Prefix: "\xff"},
+		{Prefix: "\xff\xff"},
+		{Prefix: "x"},
+		{Start: "ab"},
+		{End: "b\xff"},
+		{Start: "ab", End: "c"},
+		{Start: "b", End: "b"},
+		{Prefix: "b", Start: "b\xff\xff"},
+		{Prefix: "b\xff", End: "b\xff\xff"},
+	}
+	seeks := []string{"", "a", "abb", "b\xff", "b\xff\xff\xff", "bz", "zz", "\xff\xff\xff"}
+
+	for _, index := range []IndexType{IndexHash, IndexBTree, IndexRadix} {
+		opts := testOptions()
+		opts.Index = index
+		d := openTest(t, t.TempDir(), opts)
+		for _, key := range iteratorKeys {
+			require.NoError(t, d.Set(key, []byte("v"+key)))
+		}
+
+		// Deleted and expired keys are skipped.
+		require.NoError(t, d.Set("aa", nil))
+		require.NoError(t, d.Delete("aa"))
+		require.NoError(t, d.SetEx("b\xff\xff\xff", nil, time.Millisecond))
+		time.Sleep(5 * time.Millisecond)
+
+		for _, r := range ranges {
+			for _, reverse := range []bool{false, true} {
+				r.Reverse = reverse
+				t.Run(fmt.Sprintf("%d/%q/%q/%q/%t", index, r.Prefix, r.Start, r.End, r.Reverse), func(t *testing.T) {
+					want := inRange(iteratorKeys, r)
+					it := d.NewIterator(r)
+
+					var got []string
+					for ; it.Valid(); it.Next() {
+						if len(got) > 0 {
+							it.Prev()
+							require.True(t, it.Valid())
+							require.Equal(t, got[len(got)-1], it.Key())
+							it.Next()
+						}
+
+						value, err := it.Value()
+						require.NoError(t, err)
+						require.Equal(t, "v"+it.Key(), string(value))
+						got = append(got, it.Key())
+					}
+					require.Equal(t, want, got)
+
+					it.Prev()
+					require.False(t, it.Valid())
+					_, err := it.Value()
+					require.ErrorIs(t, err, ErrResourceNotFound)
+
+					for _, key := range seeks {
+						it.Seek(key)
+						i := slices.IndexFunc(want, func(k string) bool {
+							return (!reverse && k >= key) || (reverse && k <= key)
+						})
+						if i < 0 {
+							require.False(t, it.Valid(), "%q", key)
+							continue
+						}
+
+						require.True(t, it.Valid(), "%q", key)
+						require.Equal(t, want[i], it.Key(), "%q", key)
+					}
+
+					it.Rewind()
+					require.Equal(t, len(want) > 0, it.Valid())
+					if len(want) > 0 {
+						require.Equal(t, want[0], it.Key())
+					}
+				})
+			}
+		}
+
+		require.NoError(t, d.Close())
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"github.com/phamvinhdat/daklak/index"
+)
+
+// IndexType selects the in-memory structure that maps keys to records.
+type IndexType int
+
+const (
+	// IndexHash is a hash map. It is the fastest for point lookups but
+	// iterating it in key order needs a sorted copy of its keys.
+	IndexHash IndexType = iota
+	// IndexBTree keeps the keys sorted, so iterators and range scans walk it
+	// directly.
+	IndexBTree
+	// IndexRadix is a radix tree. It is ordered like IndexBTree and stores
+	// shared key prefixes once, which suits large keyspaces of structured
+	// keys.
+	IndexRadix
+)
+
+// keydir maps every live key to the entry of its latest record. Updates that
+// must not interleave with writes are made under Daklak.mu.
+type keydir = index.Indexer[entry]
+
+func newKeydir(t IndexType) keydir {
+	switch t {
+	case IndexBTree:
+		return index.NewBTree[entry]()
+	case IndexRadix:
+		return index.NewRadix[entry]()
+	default:
+		return index.NewHash[entry]()
+	}
+}
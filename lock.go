@@ -0,0 +1,93 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// dirLock is an advisory lock on a store directory. A writer holds lockFile
+// exclusively so a second writer cannot interleave appends with it. Readers
+// share readLockFile instead, which lets them run next to the writer while
+// still keeping out whatever needs the directory to itself.
+type dirLock struct {
+	files []*os.File
+}
+
+func lockDir(dir string, readOnly bool, mode os.FileMode) (*dirLock, error) {
+	if !readOnly {
+		return lockFiles(dir, mode, true, lockFile)
+	}
+
+	lock, err := lockFiles(dir, mode, false, readLockFile)
+	if errors.Is(err, os.ErrPermission) || readOnlyFS(err) {
+		// The lock file cannot be created where the store is read-only to
+		// us, and neither can anything a lock would keep out.
+		return &dirLock{}, nil
+	}
+
+	return lock, err
+}
+
+// lockFiles locks the named files of dir, creating them with mode if needed.
+func lockFiles(dir string, mode os.FileMode, exclusive bool, names ...string) (*dirLock, error) {
+	l := &dirLock{}
+	for _, name := range names {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_RDONLY, mode)
+		if err != nil {
+			_ = l.release()
+			return nil, err
+		}
+
+		if err = flock(f, exclusive); err != nil {
+			_ = f.Close()
+			_ = l.release()
+			if errors.Is(err, ErrLocked) {
+				return nil, fmt.Errorf("%w: %s is in use by another process", ErrLocked, dir)
+			}
+
+			return nil, err
+		}
+
+		l.files = append(l.files, f)
+	}
+
+	return l, nil
+}
+
+func (l *dirLock) release() error {
+	var returnErr error
+	for _, f := range l.files {
+		if err := funlock(f); err != nil {
+			returnErr = err
+		}
+
+		if err := f.Close(); err != nil {
+			returnErr = err
+		}
+	}
+
+	l.files = nil
+	return returnErr
+}
@@ -0,0 +1,93 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+//go:build unix
+
+package daklak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("a", []byte("1")))
+
+	_, err := NewDaklakWithOptions(dir, testOptions())
+	require.ErrorIs(t, err, ErrLocked)
+	require.ErrorIs(t, Migrate(dir), ErrLocked)
+
+	// Readers run next to the writer and each other.
+	opts := testOptions()
+	opts.ReadOnly = true
+	r1 := openTest(t, dir, opts)
+	r2 := openTest(t, dir, opts)
+	value, err := r1.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "1", string(value))
+	require.Equal(t, ErrReadOnly, r2.Delete("a"))
+
+	require.NoError(t, d.Close())
+	require.NoError(t, r1.Close())
+	require.NoError(t, r2.Close())
+
+	d = openTest(t, dir, testOptions())
+	require.NoError(t, d.Close())
+}
+
+func TestLockPerDir(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	for _, dir := range dirs {
+		d := openTest(t, dir, testOptions())
+		defer d.Close()
+	}
+
+	for _, dir := range dirs {
+		_, err := NewDaklakWithOptions(dir, testOptions())
+		require.ErrorIs(t, err, ErrLocked)
+	}
+}
+
+func TestLockReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions do not apply to root")
+	}
+
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("a", []byte("1")))
+	require.NoError(t, d.Close())
+	require.NoError(t, os.Remove(filepath.Join(dir, readLockFile)))
+
+	require.NoError(t, os.Chmod(dir, 0555))
+	defer os.Chmod(dir, 0755)
+
+	opts := testOptions()
+	opts.ReadOnly = true
+	r := openTest(t, dir, opts)
+	defer r.Close()
+	value, err := r.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "1", string(value))
+}
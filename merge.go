@@ -0,0 +1,395 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// move records where a merge copied a live record to, or that the record
+// expired and was dropped.
+type move struct {
+	key  string
+	from entry
+	to   entry
+	drop bool
+}
+
+// Merge rewrites every sealed segment into new segments holding only the live
+// records and swaps them in, so overwritten, deleted and expired records stop
+// taking disk space. Reads and writes keep working while it runs; the index is
+// only locked for the final swap.
+//
+// The merged segments get ids between the old segments and the new active
+// segment, so replaying the directory in id order gives the same result at
+// every point of a merge, even if the process dies half way.
+//
+// With Options.IncrementalBackups, deletes and expired records newer than the
+// latest backup are kept, so an incremental backup since it still has them,
+// see BackupSince.
+func (d *Daklak) Merge() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if !d.merging.CompareAndSwap(false, true) {
+		return ErrMergeInProgress
+	}
+	defer d.merging.Store(false)
+
+	keep, err := d.retainedSince()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	if d.active.empty() && len(d.segments) == 1 {
+		d.mu.Unlock()
+		return nil
+	}
+
+	// A backup in progress becomes the latest once it is done.
+	for cut := range d.cuts {
+		keep = min(keep, cut)
+	}
+
+	old := make([]*segment, 0, len(d.segments))
+	for _, seg := range d.segments {
+		old = append(old, seg)
+	}
+
+	sort.Slice(old, func(i, j int) bool { return old[i].id < old[j].id })
+	first := d.active.id + 1
+	if err := d.rotateTo(first + uint32(len(old))); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+
+	reclaimable := d.reclaimable.Load()
+	lsn := d.lsn
+	d.mu.Unlock()
+
+	m := &merger{
+		keep:        keep,
+		keys:        d.keys,
+		dir:         d.path,
+		segmentSize: d.opts.SegmentSize,
+		readHandles: d.opts.ReadHandles,
+		fileMode:    d.opts.FileMode,
+		compression: d.opts.Compression,
+		keyProvider: d.opts.KeyProvider,
+		next:        first,
+		last:        first + uint32(len(old)) - 1,
+	}
+
+	for _, seg := range old {
+		if err := m.copyLive(seg); err != nil {
+			m.abort()
+			return err
+		}
+	}
+
+	if err := m.seal(); err != nil {
+		m.abort()
+		return err
+	}
+
+	// Incremental backups can only follow what the merge kept. This has to
+	// be on disk before the old segments go.
+	if err := d.advanceBackupLSN(min(keep, lsn)); err != nil {
+		m.abort()
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.segMu.Lock()
+	defer d.segMu.Unlock()
+	for _, seg := range m.done {
+		d.segments[seg.id] = seg
+	}
+
+	for _, mv := range m.moves {
+		cur, ok := d.keys.Get(mv.key)
+		if !ok || !cur.sameRecord(mv.from) {
+			continue
+		}
+
+		if mv.drop {
+			d.keys.Delete(mv.key)
+			d.expiries.remove(mv.key)
+			if cur.value != nil {
+				d.releaseValue(*cur.value)
+			}
+
+			continue
+		}
+
+		// Keep an expiry set while the merge ran, its record follows the
+		// merged segments.
+		mv.to.expiresAt = cur.expiresAt
+		d.keys.Put(mv.key, mv.to)
+	}
+
+	var returnErr error
+	for _, seg := range old {
+		delete(d.segments, seg.id)
+		if err := seg.close(); err != nil {
+			returnErr = err
+		}
+
+		if err := os.Remove(seg.path); err != nil {
+			returnErr = err
+		}
+
+		if err := removeHint(d.path, seg.id); err != nil {
+			returnErr = err
+		}
+	}
+
+	d.reclaimable.Add(-reclaimable)
+	return returnErr
+}
+
+func (d *Daklak) mergeLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.MergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if d.shouldMerge() {
+			if err := d.Merge(); err != nil && err != ErrMergeInProgress {
+				d.logf("daklak: merge failed: %v", err)
+			}
+		}
+
+		if err := d.CollectValueLogs(); err != nil && err != ErrMergeInProgress {
+			d.logf("daklak: value log collection failed: %v", err)
+		}
+	}
+}
+
+func (d *Daklak) shouldMerge() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var total int64
+	for _, seg := range d.segments {
+		total += seg.size - seg.start
+	}
+
+	if total == 0 {
+		return false
+	}
+
+	return float64(d.reclaimable.Load())/float64(total) >= d.opts.MergeRatio
+}
+
+type merger struct {
+	keys keydir
+	// keep is the LSN after which deletes and expired records are kept.
+	keep        uint64
+	dir         string
+	segmentSize int64
+	readHandles int
+	fileMode    os.FileMode
+	compression record.Compression
+	keyProvider record.KeyProvider
+	next, last  uint32
+
+	current *segment
+	hints   []hintEntry
+	done    []*segment
+	moves   []move
+}
+
+// copyLive appends the records of seg that the index still points at to the
+// merge output.
+func (m *merger) copyLive(seg *segment) error {
+	now := time.Now()
+	return scanSegment(seg, m.keyProvider, seg.start, seg.size, func(r *record.Record, _ []byte, offset int64) error {
+		if r.Header.Type == record.TypeBatchCommit {
+			return nil
+		}
+
+		if r.Tombstone() {
+			if _, ok := m.keys.Get(r.Key); !ok && r.LSN > m.keep {
+				_, err := m.write(r)
+				return err
+			}
+
+			return nil
+		}
+
+		from, ok := m.keys.Get(r.Key)
+		if !ok && r.LSN > m.keep && r.ExpiatedAt != nil && !r.ExpiatedAt.After(now) {
+			// The key expired without a delete being written, keep one in
+			// place of the record.
+			del := record.NewDelete(r.Key)
+			del.LSN, del.WrittenAt = r.LSN, r.WrittenAt
+			_, err := m.write(del)
+			return err
+		}
+
+		if !ok || r.Header.Type == record.TypeExpire || !from.sameRecord(entry{segment: seg.id, offset: offset}) {
+			return nil
+		}
+
+		if from.expired(now) && from.lsn <= m.keep {
+			m.moves = append(m.moves, move{key: r.Key, from: from, drop: true})
+			return nil
+		}
+
+		// The expiry may have been changed since the record was written, and
+		// the LSN with it.
+		r.LSN = from.lsn
+		r.ExpiatedAt = nil
+		if from.expiresAt != 0 {
+			t := time.UnixMilli(from.expiresAt)
+			r.ExpiatedAt = &t
+		}
+
+		to, err := m.write(r)
+		if err != nil {
+			return err
+		}
+
+		m.moves = append(m.moves, move{key: r.Key, from: from, to: to})
+		return nil
+	})
+}
+
+func (m *merger) write(r *record.Record) (entry, error) {
+	out := &record.Record{
+		Key:        r.Key,
+		Value:      r.Value,
+		ExpiatedAt: r.ExpiatedAt,
+		Pointer:    r.Pointer,
+		LSN:        r.LSN,
+		WrittenAt:  r.WrittenAt,
+	}
+
+	if r.Tombstone() {
+		out = record.NewDelete(r.Key)
+		out.LSN, out.WrittenAt = r.LSN, r.WrittenAt
+	}
+
+	b, err := out.MarshalWith(m.compression, m.keyProvider)
+	if err != nil {
+		return entry{}, err
+	}
+
+	full := m.current != nil && !m.current.empty() &&
+		m.current.size+int64(len(b)) > m.segmentSize
+	if m.current == nil || (full && m.next <= m.last) {
+		if err := m.rotate(); err != nil {
+			return entry{}, err
+		}
+	}
+
+	h := hintEntry{
+		key:       r.Key,
+		tombstone: r.Tombstone(),
+		offset:    m.current.size,
+		size:      int64(len(b)),
+		value:     r.Pointer,
+		lsn:       r.LSN,
+	}
+
+	if r.ExpiatedAt != nil {
+		h.expiresAt = r.ExpiatedAt.UnixMilli()
+	}
+
+	if _, err := m.current.write(b); err != nil {
+		return entry{}, err
+	}
+
+	m.hints = append(m.hints, h)
+	return h.entry(m.current.id), nil
+}
+
+// rotate seals the current output segment and starts the next one. Output
+// segments are written under a temporary name and only take their final name
+// once they are complete.
+func (m *merger) rotate() error {
+	if err := m.seal(); err != nil {
+		return err
+	}
+
+	seg, err := openTempSegment(m.dir, m.next, m.readHandles, m.fileMode)
+	if err != nil {
+		return err
+	}
+
+	m.next++
+	m.current = seg
+	return nil
+}
+
+func (m *merger) seal() error {
+	if m.current == nil {
+		return nil
+	}
+
+	seg := m.current
+	if err := seg.seal(); err != nil {
+		return err
+	}
+
+	if err := seg.commit(m.dir); err != nil {
+		return err
+	}
+
+	if err := writeHint(m.dir, seg.id, seg.size, m.hints, m.keyProvider, m.fileMode); err != nil {
+		return err
+	}
+
+	seg.hinted = true
+	m.current = nil
+	m.hints = nil
+	m.done = append(m.done, seg)
+	return nil
+}
+
+// abort removes the output of a failed merge. The old segments are untouched
+// and the index never pointed at the output, so nothing else is needed.
+func (m *merger) abort() {
+	if m.current != nil {
+		_ = m.current.close()
+		_ = os.Remove(m.current.path)
+	}
+
+	for _, seg := range m.done {
+		_ = seg.close()
+		_ = os.Remove(seg.path)
+		_ = removeHint(m.dir, seg.id)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// mergeStore fills a store with overwritten and deleted keys spread over many
+// segments and returns what it should hold.
+func mergeStore(t *testing.T, d *Daklak) map[string]string {
+	t.Helper()
+	want := map[string]string{}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			value := strings.Repeat(string(rune('a'+round)), 10)
+			require.NoError(t, d.Set(testKey(i), []byte(value)))
+			want[testKey(i)] = value
+		}
+	}
+
+	for i := 0; i < 50; i += 3 {
+		require.NoError(t, d.Delete(testKey(i)))
+		delete(want, testKey(i))
+	}
+
+	return want
+}
+
+func mergeOptions() Options {
+	opts := testOptions()
+	opts.SegmentSize = 1 << 10
+	return opts
+}
+
+// storeFiles returns the contents of the segments and hints in dir by name.
+func storeFiles(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	files := map[string][]byte{}
+	for _, e := range entries {
+		if ext := filepath.Ext(e.Name()); ext != segmentExt && ext != hintExt {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		require.NoError(t, err)
+		files[e.Name()] = b
+	}
+
+	return files
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, mergeOptions())
+	want := mergeStore(t, d)
+	before := segmentsSize(t, dir)
+
+	require.NoError(t, d.Merge())
+	requireValues(t, d, want)
+	require.Less(t, segmentsSize(t, dir), before)
+
+	require.NoError(t, d.Set("after", []byte("merge")))
+	want["after"] = "merge"
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, mergeOptions())
+	defer d.Close()
+	requireValues(t, d, want)
+}
+
+func TestMergeCrash(t *testing.T) {
+	tests := map[string]func(t *testing.T, dir string, merged []string){
+		"old segments left": func(t *testing.T, dir string, merged []string) {},
+		"output not renamed": func(t *testing.T, dir string, merged []string) {
+			last := filepath.Join(dir, merged[len(merged)-1])
+			require.NoError(t, os.Rename(last, last+tmpExt))
+			require.NoError(t, removeHint(dir, segmentID(t, merged[len(merged)-1])))
+		},
+		"output not hinted": func(t *testing.T, dir string, merged []string) {
+			for _, name := range merged {
+				require.NoError(t, removeHint(dir, segmentID(t, name)))
+			}
+		},
+	}
+
+	for name, crash := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			d := openTest(t, dir, mergeOptions())
+			want := mergeStore(t, d)
+			old := storeFiles(t, dir)
+			require.NoError(t, d.Merge())
+			require.NoError(t, d.Close())
+
+			// The merged segments are the new ones but the active segment,
+			// which has the highest id.
+			var merged []string
+			for name := range storeFiles(t, dir) {
+				if _, ok := old[name]; !ok && filepath.Ext(name) == segmentExt {
+					merged = append(merged, name)
+				}
+			}
+			sort.Strings(merged)
+			merged = merged[:len(merged)-1]
+			require.NotEmpty(t, merged)
+
+			for name, b := range old {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, name), b, 0644))
+			}
+			crash(t, dir, merged)
+
+			d = openTest(t, dir, mergeOptions())
+			requireValues(t, d, want)
+			require.NoError(t, d.Merge())
+			requireValues(t, d, want)
+			require.NoError(t, d.Close())
+
+			tmp, err := filepath.Glob(filepath.Join(dir, "*"+tmpExt))
+			require.NoError(t, err)
+			require.Empty(t, tmp)
+
+			d = openTest(t, dir, mergeOptions())
+			defer d.Close()
+			requireValues(t, d, want)
+		})
+	}
+}
+
+func segmentID(t *testing.T, name string) uint32 {
+	t.Helper()
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 32)
+	require.NoError(t, err)
+	return uint32(id)
+}
+
+// segmentsSize returns the size of the segments of the store in dir.
+func segmentsSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	require.NoError(t, err)
+
+	var size int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		size += info.Size()
+	}
+
+	return size
+}
@@ -0,0 +1,60 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+// Migrate rewrites the store at path in the current format, including a
+// data.daklak file written by older versions. It fails with ErrLocked while
+// the store is open for writing elsewhere.
+func Migrate(path string) error {
+	opts := DefaultOptions()
+	opts.MergeInterval = 0
+	opts.SweepInterval = 0
+	opts.SyncMode = SyncAlways
+
+	d, err := NewDaklakWithOptions(path, opts)
+	if err != nil {
+		return err
+	}
+
+	if d.outdated() {
+		if err = d.Merge(); err != nil {
+			_ = d.Close()
+			return err
+		}
+	}
+
+	return d.Close()
+}
+
+// outdated reports whether a segment is in an older format than the one new
+// segments are written in.
+func (d *Daklak) outdated() bool {
+	d.segMu.RLock()
+	defer d.segMu.RUnlock()
+
+	for _, seg := range d.segments {
+		if seg.header.version != formatVersion {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,222 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// Logger receives the messages of background work, such as a merge that
+// failed. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Options configures a Daklak instance.
+type Options struct {
+	// SegmentSize is the size in bytes the active segment may grow to before
+	// it is sealed and writes move to a new segment.
+	SegmentSize int64
+
+	// MergeInterval is how often the background merge checks whether it
+	// should run. Zero disables the background merge, Merge can still be
+	// called directly.
+	MergeInterval time.Duration
+
+	// MergeRatio is the fraction of reclaimable bytes over the total size of
+	// the segments above which the background merge runs.
+	MergeRatio float64
+
+	// IncrementalBackups makes merges keep the deletes and expired records
+	// written since the latest backup, so BackupSince can still carry them.
+	// It is on by default and costs nothing until a backup is taken. Without
+	// it merges drop them, and BackupSince fails with ErrLSNTooOld for the
+	// backups taken before a merge.
+	IncrementalBackups bool
+
+	// ReadHandles is the number of file handles each segment keeps open for
+	// reads.
+	ReadHandles int
+
+	// Recovery decides what happens to a segment with a torn or corrupted
+	// tail when the store is opened.
+	Recovery RecoveryMode
+
+	// SyncMode decides when writes are flushed to stable storage.
+	SyncMode SyncMode
+
+	// SyncInterval is how often the active segment is synced when SyncMode
+	// is SyncInterval.
+	SyncInterval time.Duration
+
+	// Index selects the in-memory index structure.
+	Index IndexType
+
+	// SweepInterval is how often expired keys are evicted in the background.
+	// Zero disables the sweeper, expired keys are then only dropped when
+	// read or merged.
+	SweepInterval time.Duration
+
+	// SweepLimit is the most keys a single sweep evicts.
+	SweepLimit int
+
+	// Compression decides how values are compressed. Every record keeps the
+	// id of its codec, so this can change between opens of a store.
+	Compression record.Compression
+
+	// KeyProvider enables encryption at rest: keys and values are sealed with
+	// AES-GCM under its current key. Nil stores them in the clear. Records
+	// written under older keys stay readable as long as the provider still
+	// has them; Merge and CollectValueLogs re-encrypt them under the
+	// current key.
+	KeyProvider record.KeyProvider
+
+	// VerifyChecksums makes Get check the checksum of every record it reads.
+	// Records are always checked when segments are scanned.
+	VerifyChecksums bool
+
+	// ValueThreshold is the size from which values are written to a value
+	// log and the segments only keep a pointer to them, so merging and
+	// loading segments does not have to go through large values. Zero keeps
+	// every value inline.
+	ValueThreshold int
+
+	// ValueLogSize is the size in bytes a value log may grow to before
+	// values move to a new one.
+	ValueLogSize int64
+
+	// ValueLogGCRatio is the fraction of garbage above which a value log is
+	// rewritten by CollectValueLogs, which the background merge also runs.
+	ValueLogGCRatio float64
+
+	// MaxKeySize and MaxValueSize are the largest keys and values in bytes
+	// writes accept. Zero means no limit other than the 4 GiB the record
+	// format allows.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// ReadOnly opens the store without writing to it: no file other than its
+	// lock file is created, repaired or removed, background work does not run
+	// and writes fail with ErrReadOnly. A torn tail is ignored as with
+	// RecoveryLenient. Read-only opens can run next to the writer.
+	ReadOnly bool
+
+	// FileMode is the permission of the files the store creates. Its
+	// directory gets the same permission with execute added where read is.
+	FileMode os.FileMode
+
+	// Logger receives the messages of background work. Nil discards them.
+	Logger Logger
+}
+
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize:        defaultSegmentSize,
+		MergeInterval:      time.Minute,
+		MergeRatio:         defaultMergeRatio,
+		IncrementalBackups: true,
+		ReadHandles:        defaultReadHandles,
+		Recovery:           RecoveryRepair,
+		SyncMode:           SyncInterval,
+		SyncInterval:       defaultSyncInterval,
+		Index:              IndexHash,
+		SweepInterval:      defaultSweepInterval,
+		SweepLimit:         defaultSweepLimit,
+		VerifyChecksums:    true,
+		ValueThreshold:     defaultValueThreshold,
+		ValueLogSize:       defaultValueLogSize,
+		ValueLogGCRatio:    defaultValueLogGCRatio,
+		MaxKeySize:         defaultMaxKeySize,
+		MaxValueSize:       defaultMaxValueSize,
+		FileMode:           defaultFileMode,
+		Compression: record.Compression{
+			Codec:    record.CodecSnappy,
+			MinSize:  defaultCompressMinSize,
+			MaxRatio: defaultCompressMaxRatio,
+		},
+	}
+}
+
+// Validate checks the options. The error describes the first invalid option
+// and matches ErrInvalidOptions with errors.Is.
+func (o Options) Validate() error {
+	switch {
+	case o.SegmentSize <= 0:
+		return invalidOption("SegmentSize must be positive, got %d", o.SegmentSize)
+	case o.MergeInterval < 0:
+		return invalidOption("MergeInterval must not be negative, got %s", o.MergeInterval)
+	case o.MergeRatio < 0 || o.MergeRatio > 1:
+		return invalidOption("MergeRatio must be between 0 and 1, got %g", o.MergeRatio)
+	case o.ReadHandles <= 0:
+		return invalidOption("ReadHandles must be positive, got %d", o.ReadHandles)
+	case o.Recovery < RecoveryRepair || o.Recovery > RecoveryStrict:
+		return invalidOption("unknown Recovery %d", o.Recovery)
+	case o.SyncMode < SyncAlways || o.SyncMode > SyncNone:
+		return invalidOption("unknown SyncMode %d", o.SyncMode)
+	case o.SyncMode == SyncInterval && o.SyncInterval <= 0:
+		return invalidOption("SyncInterval must be positive with SyncInterval mode, got %s", o.SyncInterval)
+	case o.Index < IndexHash || o.Index > IndexRadix:
+		return invalidOption("unknown Index %d", o.Index)
+	case o.SweepInterval < 0:
+		return invalidOption("SweepInterval must not be negative, got %s", o.SweepInterval)
+	case o.SweepInterval > 0 && o.SweepLimit <= 0:
+		return invalidOption("SweepLimit must be positive when sweeping, got %d", o.SweepLimit)
+	case o.Compression.MinSize < 0:
+		return invalidOption("Compression.MinSize must not be negative, got %d", o.Compression.MinSize)
+	case o.Compression.MaxRatio < 0:
+		return invalidOption("Compression.MaxRatio must not be negative, got %g", o.Compression.MaxRatio)
+	case o.ValueThreshold < 0:
+		return invalidOption("ValueThreshold must not be negative, got %d", o.ValueThreshold)
+	case o.ValueThreshold > 0 && o.ValueLogSize <= 0:
+		return invalidOption("ValueLogSize must be positive when ValueThreshold is set, got %d", o.ValueLogSize)
+	case o.ValueLogGCRatio < 0 || o.ValueLogGCRatio > 1:
+		return invalidOption("ValueLogGCRatio must be between 0 and 1, got %g", o.ValueLogGCRatio)
+	case o.MaxKeySize < 0 || int64(o.MaxKeySize) > math.MaxUint32:
+		return invalidOption("MaxKeySize must be between 0 and %d, got %d", uint32(math.MaxUint32), o.MaxKeySize)
+	case o.MaxValueSize < 0 || int64(o.MaxValueSize) > math.MaxUint32:
+		return invalidOption("MaxValueSize must be between 0 and %d, got %d", uint32(math.MaxUint32), o.MaxValueSize)
+	case o.FileMode&^os.ModePerm != 0:
+		return invalidOption("FileMode must only hold permission bits, got %s", o.FileMode)
+	case o.FileMode&0600 != 0600:
+		return invalidOption("FileMode must let the owner read and write, got %s", o.FileMode)
+	}
+
+	if _, err := record.LookupCodec(o.Compression.Codec); err != nil {
+		return invalidOption("Compression.Codec: %v", err)
+	}
+
+	return nil
+}
+
+func invalidOption(format string, v ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrInvalidOptions}, v...)...)
+}
+
+// dirMode is the permission of the store directory for files created with
+// mode m.
+func dirMode(m os.FileMode) os.FileMode {
+	return m | m&0444>>2
+}
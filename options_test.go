@@ -0,0 +1,136 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	opts := DefaultOptions()
+	require.NoError(t, opts.Validate())
+	require.Nil(t, opts.Logger)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := map[string]func(opts *Options){
+		"SegmentSize":          func(opts *Options) { opts.SegmentSize = 0 },
+		"MergeInterval":        func(opts *Options) { opts.MergeInterval = -time.Second },
+		"MergeRatio":           func(opts *Options) { opts.MergeRatio = 1.5 },
+		"ReadHandles":          func(opts *Options) { opts.ReadHandles = 0 },
+		"Recovery":             func(opts *Options) { opts.Recovery = RecoveryStrict + 1 },
+		"SyncMode":             func(opts *Options) { opts.SyncMode = SyncNone + 1 },
+		"SyncInterval":         func(opts *Options) { opts.SyncInterval = 0 },
+		"Index":                func(opts *Options) { opts.Index = IndexRadix + 1 },
+		"SweepInterval":        func(opts *Options) { opts.SweepInterval = -time.Second },
+		"SweepLimit":           func(opts *Options) { opts.SweepLimit = 0 },
+		"Compression.MinSize":  func(opts *Options) { opts.Compression.MinSize = -1 },
+		"Compression.MaxRatio": func(opts *Options) { opts.Compression.MaxRatio = -1 },
+		"Compression.Codec":    func(opts *Options) { opts.Compression.Codec = 200 },
+		"ValueThreshold":       func(opts *Options) { opts.ValueThreshold = -1 },
+		"ValueLogSize":         func(opts *Options) { opts.ValueLogSize = 0 },
+		"ValueLogGCRatio":      func(opts *Options) { opts.ValueLogGCRatio = -0.5 },
+		"MaxKeySize":           func(opts *Options) { opts.MaxKeySize = -1 },
+		"MaxValueSize":         func(opts *Options) { opts.MaxValueSize = 1 << 33 },
+		"FileMode must only":   func(opts *Options) { opts.FileMode = os.ModeDir | 0644 },
+		"FileMode must let":    func(opts *Options) { opts.FileMode = 0444 },
+	}
+
+	for name, setup := range tests {
+		t.Run(name, func(t *testing.T) {
+			opts := DefaultOptions()
+			setup(&opts)
+			err := opts.Validate()
+			require.ErrorIs(t, err, ErrInvalidOptions)
+			require.True(t, strings.Contains(err.Error(), name), err.Error())
+
+			_, err = NewDaklakWithOptions(t.TempDir(), opts)
+			require.ErrorIs(t, err, ErrInvalidOptions)
+		})
+	}
+
+	// Intervals only matter for their mode, and zero disables the
+	// background work.
+	opts := DefaultOptions()
+	opts.SyncMode, opts.SyncInterval = SyncAlways, 0
+	opts.MergeInterval, opts.SweepInterval, opts.SweepLimit = 0, 0, 0
+	opts.ValueThreshold, opts.ValueLogSize = 0, 0
+	require.NoError(t, opts.Validate())
+}
+
+func TestMaxSizes(t *testing.T) {
+	opts := testOptions()
+	opts.MaxKeySize = 8
+	opts.MaxValueSize = 16
+	d := openTest(t, t.TempDir(), opts)
+	defer d.Close()
+
+	require.NoError(t, d.Set("12345678", make([]byte, 16)))
+	require.ErrorIs(t, d.Set("123456789", nil), ErrKeyTooLarge)
+	require.ErrorIs(t, d.Set("a", make([]byte, 17)), ErrValueTooLarge)
+	require.ErrorIs(t, d.SetEx("a", make([]byte, 17), time.Hour), ErrValueTooLarge)
+
+	// A batch is written whole or not at all.
+	b := NewBatch()
+	b.Set("a", []byte("1"))
+	b.Set("b", make([]byte, 17))
+	require.ErrorIs(t, d.Write(b), ErrValueTooLarge)
+	requireValues(t, d, map[string]string{"12345678": string(make([]byte, 16))})
+}
+
+func TestFileMode(t *testing.T) {
+	for _, mode := range []os.FileMode{0600, 0640} {
+		t.Run(mode.String(), func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "store")
+			opts := testOptions()
+			opts.FileMode = mode
+			opts.ValueThreshold = 16
+			opts.Compression = record.Compression{Codec: record.CodecNone}
+			d := openTest(t, dir, opts)
+			require.NoError(t, d.Set("a", []byte("1")))
+			require.NoError(t, d.Set("b", make([]byte, 64)))
+			require.NoError(t, d.Close())
+
+			info, err := os.Stat(dir)
+			require.NoError(t, err)
+			require.Equal(t, dirMode(mode), info.Mode().Perm())
+
+			err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil || entry.IsDir() {
+					return err
+				}
+
+				info, err := entry.Info()
+				require.NoError(t, err)
+				require.Equal(t, mode, info.Mode().Perm(), path)
+				return nil
+			})
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// recoverBatchSize is the number of keys RecoverTo writes at a time.
+const recoverBatchSize = 1024
+
+// PointInTime is where RecoverTo stops replaying the log: after the record
+// with LSN or, when LSN is zero, after the last record written at or before
+// Time.
+type PointInTime struct {
+	LSN  uint64
+	Time time.Time
+}
+
+// RecoverTo writes the store as it was at the point at to a new store in dir,
+// which must not exist or be empty, by replaying the log and ignoring every
+// record after that point. It runs alongside reads and writes and works on
+// read-only stores too.
+//
+// Merges drop the records that later ones override, so the result is only
+// exact for a point after the latest merge; a key whose records up to the
+// point were all dropped is missing from it, and so is a key whose value at
+// the point was in a value log CollectValueLogs has removed since. Keys that
+// had expired by the time RecoverTo runs are left out as well.
+func (d *Daklak) RecoverTo(dir string, at PointInTime) error {
+	if at.LSN == 0 && at.Time.IsZero() {
+		return errors.New("no point in time to recover to")
+	}
+
+	if err := makeEmptyDir(dir, d.opts.FileMode); err != nil {
+		return err
+	}
+
+	snap, err := d.snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.close()
+
+	lsn := at.LSN
+	if lsn == 0 {
+		if lsn, err = snap.lsnAt(at.Time); err != nil {
+			return err
+		}
+	}
+
+	keys, err := snap.replay(lsn)
+	if err != nil {
+		return err
+	}
+
+	opts := d.opts
+	opts.ReadOnly = false
+	out, err := NewDaklakWithOptions(dir, opts)
+	if err != nil {
+		return err
+	}
+
+	var ops []op
+	err = snap.live(keys, func(key string, value []byte, expiresAt int64) error {
+		put := &record.Record{Key: key, Value: value}
+		if expiresAt != 0 {
+			t := time.UnixMilli(expiresAt)
+			put.ExpiatedAt = &t
+		}
+
+		if ops = append(ops, newPut(put)); len(ops) < recoverBatchSize {
+			return nil
+		}
+
+		err := out.commit(ops...)
+		ops = nil
+		return err
+	})
+	if err == nil && len(ops) > 0 {
+		err = out.commit(ops...)
+	}
+
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// lsnAt returns the LSN of the last record of the snapshot written at or
+// before t.
+func (s *snapshot) lsnAt(t time.Time) (uint64, error) {
+	var lsn uint64
+	err := s.scan(func(_ snapshotFile, r *record.Record, _ []byte, _ int64) error {
+		if !r.WrittenAt.IsZero() && !r.WrittenAt.After(t) {
+			lsn = max(lsn, r.LSN)
+		}
+
+		return nil
+	})
+
+	return lsn, err
+}
+
+// replay rebuilds the index of the snapshot from the records up to lsn.
+func (s *snapshot) replay(lsn uint64) (keydir, error) {
+	var (
+		keys  = newKeydir(s.d.opts.Index)
+		batch batchReader
+	)
+	err := s.scan(func(seg snapshotFile, r *record.Record, raw []byte, offset int64) error {
+		if offset == seg.start {
+			batch.reset()
+		}
+
+		switch {
+		case r.Batch:
+			batch.add(r, raw, offset)
+		case r.Header.Type == record.TypeBatchCommit:
+			// The commit record has the LSN of the last record of its batch.
+			for _, h := range batch.commit(r) {
+				if r.LSN <= lsn {
+					apply(keys, seg.id, h)
+				}
+			}
+		default:
+			batch.reset()
+			if r.LSN <= lsn {
+				apply(keys, seg.id, newHintEntry(r, offset))
+			}
+		}
+
+		return nil
+	})
+
+	return keys, err
+}
+
+// live calls fn with every live key of keys, an index of the snapshot, along
+// with its value and expiry in Unix milliseconds, zero when it has none. Keys
+// whose value log is no longer in the snapshot are skipped.
+func (s *snapshot) live(keys keydir, fn func(key string, value []byte, expiresAt int64) error) error {
+	segments := make(map[uint32]snapshotFile, len(s.segments))
+	for _, seg := range s.segments {
+		segments[seg.id] = seg
+	}
+
+	var (
+		now = time.Now()
+		err error
+	)
+	keys.Iterate(func(key string, e entry) bool {
+		if e.expired(now) {
+			return true
+		}
+
+		var r *record.Record
+		r, err = s.readRecord(segments[e.segment], e)
+		switch {
+		case errors.Is(err, os.ErrNotExist), errors.Is(err, record.ErrInvalidPointer):
+			// The value was overridden and its value log collected, its
+			// place may be taken by a later value.
+			err = nil
+		case err == nil:
+			err = fn(key, r.Value, e.expiresAt)
+		}
+
+		return err == nil
+	})
+
+	return err
+}
+
+// readRecord reads the record of e from seg, with its value.
+func (s *snapshot) readRecord(seg snapshotFile, e entry) (*record.Record, error) {
+	b := make([]byte, e.size)
+	if _, err := seg.f.ReadAt(b, e.offset); err != nil {
+		return nil, err
+	}
+
+	r := &record.Record{}
+	if err := r.UnmarshalFormat(b, seg.format, s.d.opts.KeyProvider); err != nil {
+		return nil, &CorruptionError{Path: seg.path, Offset: e.offset, Err: err}
+	}
+
+	if r.Pointer != nil {
+		value, err := s.readValue(r.Key, r.LSN, *r.Pointer)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Value = value
+	}
+
+	return r, nil
+}
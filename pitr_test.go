@@ -0,0 +1,120 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func recoverTest(t *testing.T, d *Daklak, at PointInTime) *Daklak {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "recovered")
+	require.NoError(t, d.RecoverTo(dir, at))
+	return openTest(t, dir, testOptions())
+}
+
+func TestRecoverTo(t *testing.T) {
+	opts := testOptions()
+	opts.SegmentSize = 4 << 10
+	opts.ValueThreshold = 300
+	d := openTest(t, t.TempDir(), opts)
+	defer d.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		value := fmt.Sprint("good", i)
+		if i%7 == 0 {
+			value += string(bytes.Repeat([]byte{'x'}, 400))
+		}
+		require.NoError(t, d.Set(testKey(i), []byte(value)))
+		want[testKey(i)] = value
+	}
+	require.NoError(t, d.SetEx("ttl", []byte("x"), time.Hour))
+	want["ttl"] = "x"
+	require.NoError(t, d.Delete(testKey(5)))
+	delete(want, testKey(5))
+
+	b := NewBatch()
+	b.Set("b1", []byte("1"))
+	b.Set("b2", []byte("2"))
+	require.NoError(t, d.Write(b))
+	want["b1"], want["b2"] = "1", "2"
+	require.NoError(t, d.Merge())
+
+	lsn := d.LSN()
+	time.Sleep(10 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, d.Set(testKey(i), []byte("bad")))
+	}
+	require.NoError(t, d.Delete("b1"))
+	require.NoError(t, d.Set("new", []byte("bad")))
+
+	for _, point := range []PointInTime{{LSN: lsn}, {Time: at}} {
+		r := recoverTest(t, d, point)
+		requireValues(t, r, want)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestRecoverToSkipsCollectedValues(t *testing.T) {
+	opts := testOptions()
+	opts.ValueThreshold = 100
+	opts.ValueLogSize = 1 << 10
+	d := openTest(t, t.TempDir(), opts)
+	defer d.Close()
+
+	large := bytes.Repeat([]byte{'x'}, 200)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, d.Set(testKey(i), large))
+	}
+	require.NoError(t, d.Set("small", []byte("1")))
+	lsn := d.LSN()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, d.Set(testKey(i), []byte("new")))
+	}
+	require.NoError(t, d.CollectValueLogs())
+
+	r := recoverTest(t, d, PointInTime{LSN: lsn})
+	defer r.Close()
+
+	// Only the values still in the active value log survive.
+	value, err := r.Get("small")
+	require.NoError(t, err)
+	require.Equal(t, "1", string(value))
+
+	recovered := 0
+	for i := 0; i < 20; i++ {
+		if value, err = r.Get(testKey(i)); err == nil {
+			require.Equal(t, large, value)
+			recovered++
+		}
+	}
+	require.Less(t, recovered, 20)
+}
@@ -0,0 +1,136 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package rdb
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/phamvinhdat/daklak"
+)
+
+// loadBatchSize is the number of keys Load writes at a time.
+const loadBatchSize = 1024
+
+// Stats counts what Load did with the keys of a file.
+type Stats struct {
+	// Loaded counts the string keys written to the store.
+	Loaded int
+	// Expired counts the string keys that had expired already.
+	Expired int
+	// Skipped counts the keys of other types.
+	Skipped int
+}
+
+// Load writes the string keys of the RDB file r to d, with their expiries,
+// in batches. daklak has a single keyspace, like the server package, so the
+// keys of every database go to it. When Load fails, the batches before the
+// error stay written.
+func Load(d *daklak.Daklak, r io.Reader) (Stats, error) {
+	var stats Stats
+	rd, err := NewReader(r)
+	if err != nil {
+		return stats, err
+	}
+
+	b := daklak.NewBatch()
+	for {
+		e, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			stats.Skipped = rd.Skipped()
+			return stats, err
+		}
+
+		ttl := time.Until(e.ExpiresAt)
+		switch {
+		case e.ExpiresAt.IsZero():
+			b.Set(e.Key, e.Value)
+		case ttl > 0:
+			b.SetEx(e.Key, e.Value, ttl)
+		default:
+			stats.Expired++
+			continue
+		}
+
+		if b.Len() == loadBatchSize {
+			if err = d.Write(b); err != nil {
+				return stats, err
+			}
+
+			stats.Loaded += b.Len()
+			b.Reset()
+		}
+	}
+
+	stats.Skipped = rd.Skipped()
+	if err = d.Write(b); err != nil {
+		return stats, err
+	}
+
+	stats.Loaded += b.Len()
+	return stats, nil
+}
+
+// Dump writes every live key of d to w as an RDB file of database 0, with
+// the expiries of the keys. Keys written while it runs may or may not be in
+// it.
+func Dump(d *daklak.Daklak, w io.Writer) error {
+	wr, err := NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	it := d.NewIterator(daklak.IteratorOptions{})
+	for ; it.Valid(); it.Next() {
+		value, err := it.Value()
+		if errors.Is(err, daklak.ErrResourceNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ttl, err := d.TTL(it.Key())
+		if errors.Is(err, daklak.ErrResourceNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		e := &Entry{Key: it.Key(), Value: value}
+		if ttl >= 0 {
+			e.ExpiresAt = time.Now().Add(ttl)
+		}
+
+		if err = wr.Write(e); err != nil {
+			return err
+		}
+	}
+
+	return wr.Close()
+}
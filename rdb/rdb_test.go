@@ -0,0 +1,216 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/phamvinhdat/daklak"
+	"github.com/stretchr/testify/require"
+)
+
+// builder writes RDB files with what Writer does not write itself.
+type builder struct {
+	*Writer
+	buf *bytes.Buffer
+	t   *testing.T
+}
+
+func newBuilder(t *testing.T, version int) *builder {
+	buf := &bytes.Buffer{}
+	b := &builder{Writer: &Writer{w: bufio.NewWriter(buf)}, buf: buf, t: t}
+	b.raw([]byte(fmt.Sprintf("%s%04d", magic, version))...)
+	return b
+}
+
+func (b *builder) raw(p ...byte) *builder {
+	require.NoError(b.t, b.write(p))
+	return b
+}
+
+func (b *builder) length(n uint64) *builder {
+	require.NoError(b.t, b.writeLength(n))
+	return b
+}
+
+func (b *builder) str(s string) *builder {
+	require.NoError(b.t, b.writeString([]byte(s)))
+	return b
+}
+
+func (b *builder) millis(t time.Time) *builder {
+	p := make([]byte, 8)
+	binary.LittleEndian.PutUint64(p, uint64(t.UnixMilli()))
+	return b.raw(p...)
+}
+
+func (b *builder) bytes() []byte {
+	require.NoError(b.t, b.Close())
+	return b.buf.Bytes()
+}
+
+// testFile returns an RDB file with string keys in various encodings, next
+// to keys of every type Reader skips.
+func testFile(t *testing.T) []byte {
+	b := newBuilder(t, maxVersion)
+	b.raw(opAux).str("redis-ver").str("7.4.0")
+	b.raw(opSelectDB).length(0)
+	b.raw(opResizeDB).length(10).length(1)
+
+	b.raw(typeString).str("plain").str("hello")
+	b.raw(typeString).str("int8").raw(0xC0|encInt8, 0xFE)
+	b.raw(typeString).str("int16").raw(0xC0|encInt16, 0x39, 0x30)
+	b.raw(typeString).str("lzf").raw(0xC0|encLZF).length(5).length(10).raw(0x00, 'a', 0xE0, 0x00, 0x00)
+	b.raw(opExpireTimeMilli).millis(time.Now().Add(48 * time.Hour))
+	b.raw(typeString).str("future").str("x")
+	b.raw(opExpireTimeMilli).millis(time.Now().Add(-time.Hour))
+	b.raw(typeString).str("past").str("x")
+	b.raw(opIdle).length(100)
+	b.raw(typeString).str("idle").str("y")
+	b.raw(opFreq).raw(5)
+	b.raw(typeString).str("freq").str("z")
+
+	b.raw(opExpireTimeMilli).millis(time.Now().Add(time.Hour))
+	b.raw(typeList).str("list").length(2).str("a").str("b")
+	b.raw(typeSet).str("set").length(1).str("a")
+	b.raw(typeHash).str("hash").length(1).str("f").str("v")
+	b.raw(typeZSet2).str("zset").length(1).str("m").raw(make([]byte, 8)...)
+	b.raw(typeHashListpack).str("hashlp").str("listpack")
+	b.raw(typeListQuicklist2).str("quicklist").length(1).length(2).str("listpack")
+	b.raw(typeHashMetadataPreGA).str("hashttl1").length(2).
+		length(0).str("f1").str("v1").
+		length(uint64(time.Now().UnixMilli())).str("f2").str("v2")
+	b.raw(typeHashListpackExPreGA).str("hashttl2").str("listpack")
+	b.raw(typeHashMetadata).str("hashttl3").millis(time.Now()).length(1).
+		length(1).str("f").str("v")
+	b.raw(typeHashListpackEx).str("hashttl4").millis(time.Now()).str("listpack")
+
+	b.raw(opSelectDB).length(1)
+	b.raw(typeString).str("db1").str("v1")
+	return b.bytes()
+}
+
+var testValues = map[string]string{
+	"plain": "hello", "int8": "-2", "int16": "12345", "lzf": "aaaaaaaaaa",
+	"future": "x", "idle": "y", "freq": "z", "db1": "v1",
+}
+
+func openTest(t *testing.T) *daklak.Daklak {
+	opts := daklak.DefaultOptions()
+	opts.MergeInterval = 0
+	opts.SweepInterval = 0
+	d, err := daklak.NewDaklakWithOptions(t.TempDir(), opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, d.Close()) })
+	return d
+}
+
+func requireValues(t *testing.T, d *daklak.Daklak) {
+	for key, value := range testValues {
+		got, err := d.Get(key)
+		require.NoError(t, err, key)
+		require.Equal(t, value, string(got), key)
+	}
+
+	ttl, err := d.TTL("future")
+	require.NoError(t, err)
+	require.Greater(t, ttl, 47*time.Hour)
+	ttl, err = d.TTL("plain")
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(-1), ttl)
+}
+
+func TestCRC(t *testing.T) {
+	require.Equal(t, uint64(0xe9c6d914c4b8d9ca), crc(0, []byte("123456789")))
+}
+
+func TestLoadDump(t *testing.T) {
+	d := openTest(t)
+	stats, err := Load(d, bytes.NewReader(testFile(t)))
+	require.NoError(t, err)
+	require.Equal(t, Stats{Loaded: 8, Expired: 1, Skipped: 10}, stats)
+	requireValues(t, d)
+
+	var buf bytes.Buffer
+	require.NoError(t, Dump(d, &buf))
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, version, r.Version())
+
+	d = openTest(t)
+	stats, err = Load(d, &buf)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Loaded: 8}, stats)
+	requireValues(t, d)
+}
+
+func TestWriterLargeValue(t *testing.T) {
+	value := bytes.Repeat([]byte{'q'}, 70000)
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(&Entry{Key: "large", Value: value}))
+	require.NoError(t, w.Write(&Entry{DB: 2, Key: "small", Value: []byte("v")}))
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	e, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, &Entry{Key: "large", Value: value}, e)
+	e, err = r.Next()
+	require.NoError(t, err)
+	require.Equal(t, &Entry{DB: 2, Key: "small", Value: []byte("v")}, e)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestReaderInvalid(t *testing.T) {
+	file := testFile(t)
+
+	corrupted := append([]byte(nil), file...)
+	corrupted[len(corrupted)-20] ^= 0xFF
+	_, err := Load(openTest(t), bytes.NewReader(corrupted))
+	require.Error(t, err)
+
+	bad := append([]byte(nil), file...)
+	bad[len(bad)-1] ^= 0xFF
+	_, err = Load(openTest(t), bytes.NewReader(bad))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+
+	_, err = Load(openTest(t), bytes.NewReader(file[:len(file)-3]))
+	require.ErrorIs(t, err, ErrInvalidRDB)
+
+	_, err = NewReader(bytes.NewReader(newBuilder(t, maxVersion+1).bytes()))
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+	_, err = NewReader(bytes.NewReader([]byte("REDIX0009")))
+	require.ErrorIs(t, err, ErrInvalidRDB)
+
+	b := newBuilder(t, 8)
+	b.raw(typeModule).str("module").length(1)
+	_, err = Load(openTest(t), bytes.NewReader(b.bytes()))
+	require.ErrorIs(t, err, ErrUnsupportedType)
+}
@@ -0,0 +1,617 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Entry is a string key of an RDB file.
+type Entry struct {
+	// DB is the database the key is in.
+	DB    int
+	Key   string
+	Value []byte
+	// ExpiresAt is when the key expires, the zero time when it does not.
+	ExpiresAt time.Time
+}
+
+// Reader reads the string keys of an RDB file in the order they are stored,
+// skipping the keys of other types.
+type Reader struct {
+	r       *bufio.Reader
+	version int
+	db      int
+	skipped int
+	// crc is the checksum of what was read so far.
+	crc  uint64
+	done bool
+}
+
+// NewReader reads the header of the RDB file r.
+func NewReader(r io.Reader) (*Reader, error) {
+	rd := &Reader{r: bufio.NewReader(r)}
+	header := make([]byte, len(magic)+4)
+	if err := rd.read(header); err != nil {
+		return nil, err
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrInvalidRDB, header[:len(magic)])
+	}
+
+	v, err := strconv.Atoi(string(header[len(magic):]))
+	if err != nil || v < 1 {
+		return nil, fmt.Errorf("%w: bad version %q", ErrInvalidRDB, header[len(magic):])
+	}
+
+	if v > maxVersion {
+		return nil, fmt.Errorf("%w: %d, the latest supported is %d", ErrUnsupportedVersion, v, maxVersion)
+	}
+
+	rd.version = v
+	return rd, nil
+}
+
+// Version returns the RDB version of the file.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Skipped returns the number of keys of other types than string skipped so
+// far.
+func (r *Reader) Skipped() int {
+	return r.skipped
+}
+
+// Next returns the next string key. After the last one it checks the file
+// against its checksum and returns io.EOF.
+func (r *Reader) Next() (*Entry, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+
+	var expiresAt time.Time
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opEOF:
+			r.done = true
+			return nil, r.verify()
+		case opSelectDB:
+			db, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+
+			r.db = int(db)
+		case opResizeDB:
+			err = r.skipLengths(2)
+		case opSlotInfo:
+			err = r.skipLengths(3)
+		case opAux:
+			err = r.skipStrings(2)
+		case opFunction2:
+			err = r.skipStrings(1)
+		case opModuleAux:
+			if err = r.skipLengths(3); err == nil {
+				err = r.skipModuleValue()
+			}
+		case opIdle:
+			_, err = r.readLength()
+		case opFreq:
+			_, err = r.readByte()
+		case opExpireTime:
+			var b [4]byte
+			if err = r.read(b[:]); err == nil {
+				expiresAt = time.Unix(int64(binary.LittleEndian.Uint32(b[:])), 0)
+			}
+		case opExpireTimeMilli:
+			var b [8]byte
+			if err = r.read(b[:]); err == nil {
+				expiresAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(b[:])))
+			}
+		case opFunctionPreGA:
+			return nil, fmt.Errorf("%w: functions of Redis 7.0 release candidates", ErrUnsupportedType)
+		default:
+			e, err := r.readKey(op, expiresAt)
+			if err != nil || e != nil {
+				return e, err
+			}
+
+			// A key of another type, whose expiry does not carry over.
+			expiresAt = time.Time{}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readKey reads a key with a value of type t. It returns nil for keys that
+// are not strings.
+func (r *Reader) readKey(t byte, expiresAt time.Time) (*Entry, error) {
+	key, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	if t == typeString {
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		return &Entry{DB: r.db, Key: string(key), Value: value, ExpiresAt: expiresAt}, nil
+	}
+
+	if err = r.skipValue(t); err != nil {
+		return nil, err
+	}
+
+	r.skipped++
+	return nil, nil
+}
+
+// skipValue reads past a value of type t.
+func (r *Reader) skipValue(t byte) error {
+	switch t {
+	case typeList, typeSet:
+		return r.skipCollection(1)
+	case typeHash:
+		return r.skipCollection(2)
+	case typeZSet:
+		n, err := r.readLength()
+		for i := uint64(0); err == nil && i < n; i++ {
+			if err = r.skipStrings(1); err == nil {
+				err = r.skipDouble()
+			}
+		}
+
+		return err
+	case typeZSet2:
+		n, err := r.readLength()
+		for i := uint64(0); err == nil && i < n; i++ {
+			if err = r.skipStrings(1); err == nil {
+				err = r.skip(8)
+			}
+		}
+
+		return err
+	case typeHashZipmap, typeListZiplist, typeSetIntset, typeZSetZiplist, typeHashZiplist,
+		typeHashListpack, typeZSetListpack, typeSetListpack:
+		return r.skipStrings(1)
+	case typeListQuicklist:
+		return r.skipCollection(1)
+	case typeListQuicklist2:
+		// Every node is a container kind followed by a listpack.
+		n, err := r.readLength()
+		for i := uint64(0); err == nil && i < n; i++ {
+			if _, err = r.readLength(); err == nil {
+				err = r.skipStrings(1)
+			}
+		}
+
+		return err
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		return r.skipStream(t)
+	case typeHashMetadataPreGA, typeHashMetadata:
+		if t == typeHashMetadata {
+			// The earliest expiry of the fields.
+			if err := r.skip(8); err != nil {
+				return err
+			}
+		}
+
+		// Every field is its expiry, its name and its value.
+		n, err := r.readLength()
+		for i := uint64(0); err == nil && i < n; i++ {
+			if _, err = r.readLength(); err == nil {
+				err = r.skipStrings(2)
+			}
+		}
+
+		return err
+	case typeHashListpackExPreGA, typeHashListpackEx:
+		if t == typeHashListpackEx {
+			if err := r.skip(8); err != nil {
+				return err
+			}
+		}
+
+		return r.skipStrings(1)
+	case typeModule2:
+		if _, err := r.readLength(); err != nil {
+			return err
+		}
+
+		return r.skipModuleValue()
+	case typeModule:
+		return fmt.Errorf("%w: module values of Redis 4.0 release candidates", ErrUnsupportedType)
+	}
+
+	return fmt.Errorf("%w: value type %d", ErrUnsupportedType, t)
+}
+
+// skipCollection reads past a length and as many groups of size strings.
+func (r *Reader) skipCollection(size int) error {
+	n, err := r.readLength()
+	for i := uint64(0); err == nil && i < n; i++ {
+		err = r.skipStrings(size)
+	}
+
+	return err
+}
+
+// skipStream reads past a stream: its listpacks, metadata and consumer
+// groups.
+func (r *Reader) skipStream(t byte) error {
+	if err := r.skipCollection(2); err != nil {
+		return err
+	}
+
+	// The length and last id, then from the second version on the first id,
+	// the max deleted id and the number of entries ever added.
+	meta := 3
+	if t >= typeStreamListpacks2 {
+		meta += 5
+	}
+
+	if err := r.skipLengths(meta); err != nil {
+		return err
+	}
+
+	groups, err := r.readLength()
+	for i := uint64(0); err == nil && i < groups; i++ {
+		err = r.skipConsumerGroup(t)
+	}
+
+	return err
+}
+
+func (r *Reader) skipConsumerGroup(t byte) error {
+	if err := r.skipStrings(1); err != nil {
+		return err
+	}
+
+	// The last delivered id, then the read counter from the second version
+	// on.
+	meta := 2
+	if t >= typeStreamListpacks2 {
+		meta++
+	}
+
+	if err := r.skipLengths(meta); err != nil {
+		return err
+	}
+
+	// Pending entries: a raw id, the delivery time and count.
+	pending, err := r.readLength()
+	for i := uint64(0); err == nil && i < pending; i++ {
+		if err = r.skip(16 + 8); err == nil {
+			_, err = r.readLength()
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Consumers: a name, the seen time, the active time from the third
+	// version on and the raw ids of their pending entries.
+	consumers, err := r.readLength()
+	for i := uint64(0); err == nil && i < consumers; i++ {
+		if err = r.skipStrings(1); err != nil {
+			return err
+		}
+
+		times := int64(8)
+		if t >= typeStreamListpacks3 {
+			times += 8
+		}
+
+		if err = r.skip(times); err != nil {
+			return err
+		}
+
+		pending, err = r.readLength()
+		if err == nil && pending > math.MaxInt64/16 {
+			err = fmt.Errorf("%w: %d pending entries", ErrInvalidRDB, pending)
+		}
+
+		if err == nil {
+			err = r.skip(int64(pending) * 16)
+		}
+	}
+
+	return err
+}
+
+// skipModuleValue reads past the value of a module saved with opcodes.
+func (r *Reader) skipModuleValue() error {
+	for {
+		op, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, err = r.readLength()
+		case moduleOpFloat:
+			err = r.skip(4)
+		case moduleOpDouble:
+			err = r.skip(8)
+		case moduleOpString:
+			err = r.skipStrings(1)
+		default:
+			err = fmt.Errorf("%w: module opcode %d", ErrInvalidRDB, op)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipDouble reads past a double of a typeZSet value, saved as a string
+// with a one byte length that is also used for NaN and the infinities.
+func (r *Reader) skipDouble() error {
+	n, err := r.readByte()
+	if err != nil || n >= 253 {
+		return err
+	}
+
+	return r.skip(int64(n))
+}
+
+func (r *Reader) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := r.readLength(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Reader) skipStrings(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := r.readString(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readString reads a string, which may be saved as an integer or
+// compressed with LZF.
+func (r *Reader) readString() ([]byte, error) {
+	n, encoded, err := r.readEncodedLength()
+	if err != nil {
+		return nil, err
+	}
+
+	if !encoded {
+		if n > maxStringLength {
+			return nil, fmt.Errorf("%w: string of %d bytes", ErrInvalidRDB, n)
+		}
+
+		b := make([]byte, n)
+		return b, r.read(b)
+	}
+
+	switch n {
+	case encInt8:
+		b, err := r.readByte()
+		return strconv.AppendInt(nil, int64(int8(b)), 10), err
+	case encInt16:
+		var b [2]byte
+		err := r.read(b[:])
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b[:]))), 10), err
+	case encInt32:
+		var b [4]byte
+		err := r.read(b[:])
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b[:]))), 10), err
+	case encLZF:
+		compressed, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		if compressed > maxStringLength || size > maxStringLength {
+			return nil, fmt.Errorf("%w: compressed string of %d bytes", ErrInvalidRDB, size)
+		}
+
+		b := make([]byte, compressed)
+		if err = r.read(b); err != nil {
+			return nil, err
+		}
+
+		return lzfDecompress(b, int(size))
+	}
+
+	return nil, fmt.Errorf("%w: string encoding %d", ErrInvalidRDB, n)
+}
+
+func (r *Reader) readLength() (uint64, error) {
+	n, encoded, err := r.readEncodedLength()
+	if err == nil && encoded {
+		err = fmt.Errorf("%w: encoded string where a length belongs", ErrInvalidRDB)
+	}
+
+	return n, err
+}
+
+// readEncodedLength reads a length. When encoded is set it is the special
+// encoding of the string that follows instead.
+func (r *Reader) readEncodedLength() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := r.readByte()
+		return uint64(b&0x3F)<<8 | uint64(next), false, err
+	case 3:
+		return uint64(b & 0x3F), true, nil
+	}
+
+	switch b {
+	case 0x80:
+		var buf [4]byte
+		err = r.read(buf[:])
+		return uint64(binary.BigEndian.Uint32(buf[:])), false, err
+	case 0x81:
+		var buf [8]byte
+		err = r.read(buf[:])
+		return binary.BigEndian.Uint64(buf[:]), false, err
+	}
+
+	return 0, false, fmt.Errorf("%w: length encoding %#x", ErrInvalidRDB, b)
+}
+
+// verify checks the checksum that follows the end of the file. Files written
+// before version 5, or with checksums turned off, have none.
+func (r *Reader) verify() error {
+	if r.version < 5 {
+		return io.EOF
+	}
+
+	want := r.crc
+	var b [8]byte
+	if err := r.read(b[:]); err != nil {
+		return err
+	}
+
+	if sum := binary.LittleEndian.Uint64(b[:]); sum != 0 && sum != want {
+		return fmt.Errorf("%w: got %#016x, want %#016x", ErrChecksumMismatch, want, sum)
+	}
+
+	return io.EOF
+}
+
+func (r *Reader) skip(n int64) error {
+	buf := make([]byte, min(n, 32<<10))
+	for n > 0 {
+		chunk := buf[:min(n, int64(len(buf)))]
+		if err := r.read(chunk); err != nil {
+			return err
+		}
+
+		n -= int64(len(chunk))
+	}
+
+	return nil
+}
+
+func (r *Reader) readByte() (byte, error) {
+	var b [1]byte
+	err := r.read(b[:])
+	return b[0], err
+}
+
+// read fills b from the file, a file that ends first is cut short.
+func (r *Reader) read(b []byte) error {
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: %v", ErrInvalidRDB, io.ErrUnexpectedEOF)
+		}
+
+		return err
+	}
+
+	r.crc = crc(r.crc, b)
+	return nil
+}
+
+// lzfDecompress decompresses the LZF data b into size bytes.
+func lzfDecompress(b []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	for i := 0; i < len(b); {
+		ctrl := int(b[i])
+		i++
+		if ctrl < 1<<5 {
+			// A run of ctrl+1 literal bytes.
+			n := ctrl + 1
+			if i+n > len(b) || len(out)+n > size {
+				return nil, fmt.Errorf("%w: bad LZF literal", ErrInvalidRDB)
+			}
+
+			out = append(out, b[i:i+n]...)
+			i += n
+			continue
+		}
+
+		// A back reference of length+2 bytes.
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(b) {
+				return nil, fmt.Errorf("%w: bad LZF reference", ErrInvalidRDB)
+			}
+
+			length += int(b[i])
+			i++
+		}
+
+		if i >= len(b) {
+			return nil, fmt.Errorf("%w: bad LZF reference", ErrInvalidRDB)
+		}
+
+		ref := len(out) - (ctrl&0x1F)<<8 - int(b[i]) - 1
+		i++
+		if ref < 0 || len(out)+length+2 > size {
+			return nil, fmt.Errorf("%w: bad LZF reference", ErrInvalidRDB)
+		}
+
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != size {
+		return nil, fmt.Errorf("%w: LZF data of %d bytes, want %d", ErrInvalidRDB, len(out), size)
+	}
+
+	return out, nil
+}
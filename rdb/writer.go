@@ -0,0 +1,131 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Writer writes string keys as an RDB file Redis can load.
+type Writer struct {
+	w        *bufio.Writer
+	db       int
+	selected bool
+	// crc is the checksum of what was written so far.
+	crc uint64
+}
+
+// NewWriter writes the header of an RDB file to w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	wr := &Writer{w: bufio.NewWriter(w)}
+	if err := wr.write([]byte(fmt.Sprintf("%s%04d", magic, version))); err != nil {
+		return nil, err
+	}
+
+	return wr, nil
+}
+
+// Write writes e. Keys of the same database are best written together.
+func (w *Writer) Write(e *Entry) error {
+	if !w.selected || e.DB != w.db {
+		if err := w.write([]byte{opSelectDB}); err != nil {
+			return err
+		}
+
+		if err := w.writeLength(uint64(e.DB)); err != nil {
+			return err
+		}
+
+		w.db, w.selected = e.DB, true
+	}
+
+	if !e.ExpiresAt.IsZero() {
+		b := []byte{opExpireTimeMilli, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(b[1:], uint64(e.ExpiresAt.UnixMilli()))
+		if err := w.write(b); err != nil {
+			return err
+		}
+	}
+
+	if err := w.write([]byte{typeString}); err != nil {
+		return err
+	}
+
+	if err := w.writeString([]byte(e.Key)); err != nil {
+		return err
+	}
+
+	return w.writeString(e.Value)
+}
+
+// Close ends the file with its checksum and flushes it. It does not close
+// the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.write([]byte{opEOF}); err != nil {
+		return err
+	}
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], w.crc)
+	if _, err := w.w.Write(b[:]); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+func (w *Writer) writeString(b []byte) error {
+	if err := w.writeLength(uint64(len(b))); err != nil {
+		return err
+	}
+
+	return w.write(b)
+}
+
+// writeLength writes n in as few bytes as the encoding allows.
+func (w *Writer) writeLength(n uint64) error {
+	switch {
+	case n < 1<<6:
+		return w.write([]byte{byte(n)})
+	case n < 1<<14:
+		return w.write([]byte{0x40 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		b := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return w.write(b)
+	}
+
+	b := []byte{0x81, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], n)
+	return w.write(b)
+}
+
+func (w *Writer) write(b []byte) error {
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+
+	w.crc = crc(w.crc, b)
+	return nil
+}
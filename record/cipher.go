@@ -0,0 +1,189 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package record
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	nonceSize = 12
+	tagSize   = 16
+
+	// SealOverhead is the number of bytes Seal adds to a plaintext: the key
+	// id (4), the nonce and the GCM tag.
+	SealOverhead = 4 + nonceSize + tagSize
+
+	// KeyIDPrefixSize is the most bytes of a FormatCRC32C record KeyID
+	// needs: the header, the fields before the key and the key id.
+	KeyIDPrefixSize = HeaderSize + 8 + 8 + 1 + 8 + 4
+)
+
+var (
+	ErrUnknownKey = errors.New("ERR_UNKNOWN_KEY")
+	// ErrEncrypted is returned when reading an encrypted record without a
+	// KeyProvider.
+	ErrEncrypted = errors.New("ERR_ENCRYPTED")
+	// ErrDecryptionFailed is returned when sealed data does not open with
+	// the key its id names, which usually means the key is wrong.
+	ErrDecryptionFailed = errors.New("ERR_DECRYPTION_FAILED")
+)
+
+// KeyProvider supplies the AES keys records are encrypted with. Every
+// encrypted record stores the id of its key, so a key that is rotated out
+// must stay available until no record uses it anymore; a merge re-encrypts
+// every record it keeps under the current key.
+type KeyProvider interface {
+	// Current returns the key new records are encrypted with.
+	Current() (id uint32, key []byte, err error)
+	// Key returns the key with the given id.
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding its keys in memory.
+type KeyRing struct {
+	mu      sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[uint32][]byte)}
+}
+
+// Add adds an AES-128, AES-192 or AES-256 key and makes it the current one.
+func (k *KeyRing) Add(id uint32, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+	k.current = id
+	return nil
+}
+
+func (k *KeyRing) Current() (uint32, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[k.current]
+	if !ok {
+		return 0, nil, ErrUnknownKey
+	}
+
+	return k.current, key, nil
+}
+
+func (k *KeyRing) Key(id uint32) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+// Seal encrypts plaintext with AES-GCM under the current key of keys,
+// authenticating aad along with it. It returns the key id, the nonce and the
+// ciphertext.
+func Seal(keys KeyProvider, plaintext, aad []byte) ([]byte, error) {
+	id, key, err := keys.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 4+nonceSize, len(plaintext)+SealOverhead)
+	binary.LittleEndian.PutUint32(b, id)
+	if _, err = rand.Read(b[4:]); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(b, b[4:], plaintext, aad), nil
+}
+
+// Open decrypts what Seal returned.
+func Open(keys KeyProvider, sealed, aad []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrEncrypted
+	}
+
+	if len(sealed) < SealOverhead {
+		return nil, ErrDecryptionFailed
+	}
+
+	key, err := keys.Key(binary.LittleEndian.Uint32(sealed))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[4:4+nonceSize], sealed[4+nonceSize:], aad)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return plaintext, nil
+}
+
+// KeyID returns the id of the key the FormatCRC32C record starting in b is
+// encrypted under, or false when it is not encrypted. b does not need to hold
+// more of the record than KeyIDPrefixSize bytes.
+func KeyID(b []byte) (uint32, bool, error) {
+	h, err := NewHeader(b)
+	if err != nil || !h.Encrypted {
+		return 0, false, err
+	}
+
+	off := HeaderSize + h.fieldsSize()
+	if int64(len(b)) < off+4 {
+		return 0, false, io.ErrUnexpectedEOF
+	}
+
+	return binary.LittleEndian.Uint32(b[off:]), true, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
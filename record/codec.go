@@ -0,0 +1,128 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package record
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// CodecID identifies the codec a value was encoded with. Every record stores
+// the id of its codec, so records encoded with different codecs can share a
+// file.
+type CodecID uint8
+
+const (
+	CodecNone CodecID = iota
+	CodecSnappy
+)
+
+var ErrUnknownCodec = errors.New("ERR_UNKNOWN_CODEC")
+
+// Codec compresses values.
+type Codec interface {
+	ID() CodecID
+	Encode(value []byte) []byte
+	Decode(encoded []byte) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[CodecID]Codec{
+		CodecNone:   noneCodec{},
+		CodecSnappy: snappyCodec{},
+	}
+)
+
+// RegisterCodec makes c available to encode and decode values. It panics if
+// a codec with the same id is already registered.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, ok := codecs[c.ID()]; ok {
+		panic(fmt.Sprintf("record: codec %d registered twice", c.ID()))
+	}
+
+	codecs[c.ID()] = c
+}
+
+// LookupCodec returns the codec registered under id.
+func LookupCodec(id CodecID) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, id)
+	}
+
+	return c, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() CodecID                           { return CodecNone }
+func (noneCodec) Encode(value []byte) []byte            { return value }
+func (noneCodec) Decode(encoded []byte) ([]byte, error) { return encoded, nil }
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() CodecID                { return CodecSnappy }
+func (snappyCodec) Encode(value []byte) []byte { return snappy.Encode(nil, value) }
+func (snappyCodec) Decode(encoded []byte) ([]byte, error) {
+	return snappy.Decode(nil, encoded)
+}
+
+// Compression decides which codec each value is encoded with.
+type Compression struct {
+	Codec CodecID
+
+	// MinSize is the size below which values are stored uncompressed.
+	MinSize int
+
+	// MaxRatio is the largest compressed to raw size ratio worth keeping;
+	// values that compress worse are stored uncompressed. Zero keeps every
+	// compressed value.
+	MaxRatio float64
+}
+
+// DefaultCompression snappy-encodes every value.
+var DefaultCompression = Compression{Codec: CodecSnappy}
+
+func (c Compression) encode(value []byte) (CodecID, []byte, error) {
+	if c.Codec == CodecNone || len(value) < c.MinSize {
+		return CodecNone, value, nil
+	}
+
+	codec, err := LookupCodec(c.Codec)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	encoded := codec.Encode(value)
+	if c.MaxRatio > 0 && float64(len(encoded)) > c.MaxRatio*float64(len(value)) {
+		return CodecNone, value, nil
+	}
+
+	return c.Codec, encoded, nil
+}
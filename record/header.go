@@ -23,50 +23,178 @@ package record
 import (
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"io"
 )
 
 const (
-	HeaderSize = 1 + 4 + 4 + md5.Size
+	// HeaderSize is the size of a FormatCRC32C header: a CRC32C of the rest
+	// of the record (4), type (1), flags (1), key length (4) and data length
+	// (4).
+	HeaderSize = 4 + 1 + 1 + 4 + 4
+	// LegacyHeaderSize is the size of a FormatMD5 header: type (1), key
+	// length (4), data length (4) and an MD5 of the data.
+	LegacyHeaderSize = 1 + 4 + 4 + md5.Size
 )
 
+var (
+	ErrChecksumMismatch = errors.New("ERR_CHECKSUM_MISMATCH")
+	ErrNoLSN            = errors.New("ERR_NO_LSN")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Format is a layout records are encoded in.
+type Format int
+
+const (
+	// FormatMD5 is the layout of records written before FormatCRC32C. Only
+	// the encoded value is checksummed.
+	FormatMD5 Format = iota
+	// FormatCRC32C checksums the whole record. Marshal always writes it.
+	FormatCRC32C
+)
+
+func (f Format) HeaderSize() int64 {
+	if f == FormatMD5 {
+		return LegacyHeaderSize
+	}
+
+	return HeaderSize
+}
+
+// Type is the kind of a record.
+//
+// Files written before TypeDelete existed mark deletes with a TypePersistence
+// record without data. Values written since either have data or carry a
+// codec id, so only such a record without a codec id is a legacy delete.
 type Type int8
 
 const (
 	TypePersistence Type = iota
 	TypeTTL
+	TypeBatchCommit
+	// TypeExpire changes the expiry of a key without rewriting its value. A
+	// zero expiry makes the key persistent.
+	TypeExpire
+	TypeDelete
 )
 
+// Flags of a FormatCRC32C header.
+const (
+	// flagBatch is set for the records written by a batch.
+	flagBatch = 1 << iota
+	// flagCodec is set when the body starts with the id of the codec of the
+	// data. Records without it were snappy-encoded.
+	flagCodec
+	// flagEncrypted is set when the key and data are sealed, see Seal.
+	flagEncrypted
+	// flagPointer is set when the data is a ValuePointer to the value.
+	flagPointer
+	// flagLSN is set when the body starts with the log sequence number of
+	// the record.
+	flagLSN
+	// flagTime is set when the time the record was written follows the LSN.
+	flagTime
+)
+
+// legacyBatchFlag marks batch records in the type byte of FormatMD5 headers.
+const legacyBatchFlag = 0x40
+
 type Header struct {
+	Format     Format
 	Type       Type
+	Batch      bool
+	Encrypted  bool
+	Pointer    bool
 	KeyLength  uint32
 	DataLength uint32
-	Checksum   []byte
+	Codec      CodecID
+
+	// Checksum is the CRC32C of a FormatCRC32C record.
+	Checksum uint32
+	// legacyChecksum is the MD5 of the data of a FormatMD5 record.
+	legacyChecksum []byte
+	// codecField is set when the codec id is stored in the body.
+	codecField bool
+	// lsnField is set when the LSN is stored in the body, timeField when
+	// the time of the write is.
+	lsnField  bool
+	timeField bool
 }
 
+// Marshal encodes h in FormatCRC32C.
 func (h Header) Marshal() []byte {
 	headerBytes := make([]byte, HeaderSize)
-	headerBytes[0] = byte(h.Type)
-	binary.LittleEndian.PutUint32(headerBytes[1:], h.KeyLength)
-	binary.LittleEndian.PutUint32(headerBytes[1+4:], h.DataLength)
-	for i, b := range h.Checksum {
-		headerBytes[1+4+4+i] = b
+	binary.LittleEndian.PutUint32(headerBytes, h.Checksum)
+	headerBytes[4] = byte(h.Type)
+	if h.Batch {
+		headerBytes[4+1] |= flagBatch
+	}
+
+	if h.codecField {
+		headerBytes[4+1] |= flagCodec
+	}
+
+	if h.Encrypted {
+		headerBytes[4+1] |= flagEncrypted
+	}
+
+	if h.Pointer {
+		headerBytes[4+1] |= flagPointer
+	}
+
+	if h.lsnField {
+		headerBytes[4+1] |= flagLSN
+	}
+
+	if h.timeField {
+		headerBytes[4+1] |= flagTime
 	}
 
+	binary.LittleEndian.PutUint32(headerBytes[4+1+1:], h.KeyLength)
+	binary.LittleEndian.PutUint32(headerBytes[4+1+1+4:], h.DataLength)
 	return headerBytes
 }
 
+// Unmarshal decodes a FormatCRC32C header.
 func (h *Header) Unmarshal(b []byte) error {
-	h.Type = Type(b[0])
-	h.KeyLength = binary.LittleEndian.Uint32(b[1:])
-	h.DataLength = binary.LittleEndian.Uint32(b[1+4:])
-	h.Checksum = b[1+4+4 : HeaderSize]
+	return h.UnmarshalFormat(b, FormatCRC32C)
+}
+
+func (h *Header) UnmarshalFormat(b []byte, f Format) error {
+	if int64(len(b)) < f.HeaderSize() {
+		return io.ErrUnexpectedEOF
+	}
+
+	h.Format = f
+	h.Codec = CodecSnappy
+	if f == FormatMD5 {
+		h.Type = Type(b[0] &^ legacyBatchFlag)
+		h.Batch = b[0]&legacyBatchFlag != 0
+		h.KeyLength = binary.LittleEndian.Uint32(b[1:])
+		h.DataLength = binary.LittleEndian.Uint32(b[1+4:])
+		h.legacyChecksum = b[1+4+4 : LegacyHeaderSize]
+		return nil
+	}
+
+	h.Checksum = binary.LittleEndian.Uint32(b)
+	h.Type = Type(b[4])
+	h.Batch = b[4+1]&flagBatch != 0
+	h.codecField = b[4+1]&flagCodec != 0
+	h.Encrypted = b[4+1]&flagEncrypted != 0
+	h.Pointer = b[4+1]&flagPointer != 0
+	h.lsnField = b[4+1]&flagLSN != 0
+	h.timeField = b[4+1]&flagTime != 0
+	h.KeyLength = binary.LittleEndian.Uint32(b[4+1+1:])
+	h.DataLength = binary.LittleEndian.Uint32(b[4+1+1+4:])
 	return nil
 }
 
 func (h *Header) FromReader(reader io.Reader) error {
 	makeHeader := make([]byte, HeaderSize)
-	_, err := reader.Read(makeHeader)
+	_, err := io.ReadFull(reader, makeHeader)
 	if err != nil {
 		return err
 	}
@@ -75,14 +203,40 @@ func (h *Header) FromReader(reader io.Reader) error {
 }
 
 func NewHeader(b []byte) (*Header, error) {
+	return NewHeaderFormat(b, FormatCRC32C)
+}
+
+func NewHeaderFormat(b []byte, f Format) (*Header, error) {
 	h := &Header{}
-	err := h.Unmarshal(b)
+	err := h.UnmarshalFormat(b, f)
 	return h, err
 }
 
 func (h *Header) BodySize() int64 {
-	s := int64(h.KeyLength + h.DataLength)
-	if h.Type == TypeTTL {
+	s := h.fieldsSize() + int64(h.KeyLength) + int64(h.DataLength)
+	if h.Encrypted {
+		s += SealOverhead
+	}
+
+	return s
+}
+
+// fieldsSize returns the size of the fields of the body before the key.
+func (h *Header) fieldsSize() int64 {
+	var s int64
+	if h.lsnField {
+		s += 8
+	}
+
+	if h.timeField {
+		s += 8
+	}
+
+	if h.codecField {
+		s++
+	}
+
+	if h.Type == TypeTTL || h.Type == TypeExpire {
 		s += 8
 	}
 
@@ -0,0 +1,59 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// PointerSize is the size of a marshalled ValuePointer: file (4), offset (8)
+// and size (8).
+const PointerSize = 4 + 8 + 8
+
+var ErrInvalidPointer = errors.New("ERR_INVALID_POINTER")
+
+// ValuePointer locates a value stored apart from its key, as the record
+// written at Offset of value log File.
+type ValuePointer struct {
+	File   uint32
+	Offset int64
+	Size   int64
+}
+
+func (p ValuePointer) Marshal() []byte {
+	b := make([]byte, PointerSize)
+	binary.LittleEndian.PutUint32(b, p.File)
+	binary.LittleEndian.PutUint64(b[4:], uint64(p.Offset))
+	binary.LittleEndian.PutUint64(b[4+8:], uint64(p.Size))
+	return b
+}
+
+func (p *ValuePointer) Unmarshal(b []byte) error {
+	if len(b) != PointerSize {
+		return ErrInvalidPointer
+	}
+
+	p.File = binary.LittleEndian.Uint32(b)
+	p.Offset = int64(binary.LittleEndian.Uint64(b[4:]))
+	p.Size = int64(binary.LittleEndian.Uint64(b[4+8:]))
+	return nil
+}
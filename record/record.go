@@ -21,12 +21,12 @@
 package record
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"time"
-
-	"github.com/golang/snappy"
 )
 
 type Record struct {
@@ -34,6 +34,20 @@ type Record struct {
 	ExpiatedAt *time.Time
 	Key        string
 	Value      []byte
+
+	// Pointer locates the value when it is stored in a value log rather
+	// than in the record. Value is nil then.
+	Pointer *ValuePointer
+
+	// LSN is the log sequence number of the record, zero for records written
+	// before there were any. WrittenAt is when it was written, zero when not
+	// known. See Stamp.
+	LSN       uint64
+	WrittenAt time.Time
+
+	// Batch marks a record written as part of a batch. Such records only
+	// count once the TypeBatchCommit record that follows them is read.
+	Batch bool
 }
 
 func NewRecord(key string, value []byte, ttl *time.Duration) *Record {
@@ -50,43 +64,131 @@ func NewRecord(key string, value []byte, ttl *time.Duration) *Record {
 	return r
 }
 
-func (r *Record) Marshal() []byte {
-	var (
-		encoded  []byte
-		checksum = [md5.Size]byte{}
-	)
-	if len(r.Value) > 0 {
-		encoded = snappy.Encode(nil, r.Value)
-		checksum = md5.Sum(encoded)
+// NewBatchCommit returns the record that commits the count batch records
+// before it. checksum is a CRC32C of those records as written.
+func NewBatchCommit(count, checksum uint32) *Record {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint32(value, count)
+	binary.LittleEndian.PutUint32(value[4:], checksum)
+	return &Record{
+		Header: &Header{Type: TypeBatchCommit},
+		Value:  value,
 	}
+}
 
+// NewExpire returns the record that sets the expiry of key to at, or makes
+// it persistent when at is nil.
+func NewExpire(key string, at *time.Time) *Record {
+	return &Record{
+		Header:     &Header{Type: TypeExpire},
+		ExpiatedAt: at,
+		Key:        key,
+	}
+}
+
+// NewDelete returns the tombstone of key.
+func NewDelete(key string) *Record {
+	return &Record{
+		Header: &Header{Type: TypeDelete},
+		Key:    key,
+	}
+}
+
+// BatchCommit returns the record count and checksum of a TypeBatchCommit
+// record.
+func (r Record) BatchCommit() (count, checksum uint32, ok bool) {
+	if r.Header == nil || r.Header.Type != TypeBatchCommit || len(r.Value) != 8 {
+		return 0, 0, false
+	}
+
+	return binary.LittleEndian.Uint32(r.Value), binary.LittleEndian.Uint32(r.Value[4:]), true
+}
+
+// Marshal encodes r with DefaultCompression and without encryption.
+func (r *Record) Marshal() []byte {
+	b, _ := r.MarshalWith(DefaultCompression, nil)
+	return b
+}
+
+// MarshalWith encodes r in FormatCRC32C, compressing its value as c decides.
+// When keys is not nil the key and value are encrypted under its current
+// key; the header and expiry stay readable but are authenticated.
+func (r *Record) MarshalWith(c Compression, keys KeyProvider) ([]byte, error) {
 	h := &Header{
-		KeyLength:  uint32(len(r.Key)),
-		DataLength: uint32(len(encoded)),
-		Checksum:   checksum[:],
+		Batch:     r.Batch,
+		Encrypted: keys != nil,
+		KeyLength: uint32(len(r.Key)),
+		lsnField:  true,
+		timeField: true,
 	}
 
 	if r.ExpiatedAt != nil {
 		h.Type = TypeTTL
 	}
 
-	body := make([]byte, 0, h.BodySize())
-	if h.Type == TypeTTL {
+	if r.Header != nil {
+		switch r.Header.Type {
+		case TypeBatchCommit, TypeExpire, TypeDelete:
+			h.Type = r.Header.Type
+		}
+	}
+
+	var encoded []byte
+	if r.Pointer != nil && (h.Type == TypePersistence || h.Type == TypeTTL) {
+		h.Pointer = true
+		encoded = r.Pointer.Marshal()
+	} else if h.Type != TypeExpire && h.Type != TypeDelete {
+		var err error
+		h.Codec, encoded, err = c.encode(r.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		h.codecField = true
+	}
+
+	h.DataLength = uint32(len(encoded))
+
+	b := make([]byte, HeaderSize, HeaderSize+h.BodySize())
+	b = binary.LittleEndian.AppendUint64(b, r.LSN)
+	b = binary.LittleEndian.AppendUint64(b, unixMilli(r.WrittenAt))
+	if h.codecField {
+		b = append(b, byte(h.Codec))
+	}
+
+	if h.Type == TypeTTL || h.Type == TypeExpire {
 		ttlBytes := make([]byte, 8)
-		unixMilli := r.ExpiatedAt.UnixMilli()
-		binary.LittleEndian.PutUint64(ttlBytes, uint64(unixMilli))
-		body = append(body, ttlBytes...)
+		if r.ExpiatedAt != nil {
+			binary.LittleEndian.PutUint64(ttlBytes, uint64(r.ExpiatedAt.UnixMilli()))
+		}
+
+		b = append(b, ttlBytes...)
+	}
+
+	copy(b, h.Marshal())
+	if h.Encrypted {
+		plaintext := make([]byte, 0, len(r.Key)+len(encoded))
+		plaintext = append(plaintext, r.Key...)
+		plaintext = append(plaintext, encoded...)
+		sealed, err := Seal(keys, plaintext, aad(b[:HeaderSize], b[HeaderSize+16:]))
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, sealed...)
+	} else {
+		b = append(b, []byte(r.Key)...)
+		b = append(b, encoded...)
 	}
 
-	body = append(body, []byte(r.Key)...)
-	body = append(body, encoded...)
-	headerBytes := h.Marshal()
-	return append(headerBytes, body...)
+	binary.LittleEndian.PutUint32(b, crc32.Checksum(b[4:], crcTable))
+	return b, nil
 }
 
+// FromReader reads and verifies a FormatCRC32C record.
 func (r *Record) FromReader(reader io.Reader) error {
 	bytesHeader := make([]byte, HeaderSize)
-	_, err := reader.Read(bytesHeader)
+	_, err := io.ReadFull(reader, bytesHeader)
 	if err != nil {
 		return err
 	}
@@ -96,32 +198,195 @@ func (r *Record) FromReader(reader io.Reader) error {
 		return err
 	}
 
-	kv := make([]byte, h.BodySize())
-	_, err = reader.Read(kv)
+	b := make([]byte, HeaderSize+h.BodySize())
+	copy(b, bytesHeader)
+	_, err = io.ReadFull(reader, b[HeaderSize:])
+	if err != nil {
+		return err
+	}
+
+	if err = Verify(b, FormatCRC32C); err != nil {
+		return err
+	}
+
+	return r.unmarshalBody(h, bytesHeader, b[HeaderSize:], nil)
+}
+
+// Unmarshal decodes a plaintext record from b, which must hold the whole
+// record as written by Marshal. It does not verify the checksum, see Verify.
+func (r *Record) Unmarshal(b []byte) error {
+	return r.UnmarshalFormat(b, FormatCRC32C, nil)
+}
+
+// UnmarshalFormat decodes a record in format f, decrypting it with keys if
+// it is encrypted.
+func (r *Record) UnmarshalFormat(b []byte, f Format, keys KeyProvider) error {
+	h, err := NewHeaderFormat(b, f)
 	if err != nil {
 		return err
 	}
 
+	headerSize := f.HeaderSize()
+	if int64(len(b))-headerSize < h.BodySize() {
+		return io.ErrUnexpectedEOF
+	}
+
+	return r.unmarshalBody(h, b[:headerSize], b[headerSize:headerSize+h.BodySize()], keys)
+}
+
+func (r *Record) unmarshalBody(h *Header, header, kv []byte, keys KeyProvider) error {
+	r.LSN = 0
+	if h.lsnField {
+		r.LSN = binary.LittleEndian.Uint64(kv)
+		kv = kv[8:]
+	}
+
+	r.WrittenAt = time.Time{}
+	if h.timeField {
+		if ms := binary.LittleEndian.Uint64(kv); ms != 0 {
+			r.WrittenAt = time.UnixMilli(int64(ms))
+		}
+
+		kv = kv[8:]
+	}
+
 	var off uint32
-	if h.Type == TypeTTL {
-		num := binary.LittleEndian.Uint64(kv)
-		t := time.UnixMilli(int64(num))
-		r.ExpiatedAt = &t
-		off = 8
+	if h.codecField {
+		h.Codec = CodecID(kv[0])
+		off = 1
+	}
+
+	if h.Type == TypeTTL || h.Type == TypeExpire {
+		num := binary.LittleEndian.Uint64(kv[off:])
+		if h.Type == TypeTTL || num != 0 {
+			t := time.UnixMilli(int64(num))
+			r.ExpiatedAt = &t
+		}
+
+		off += 8
 	}
 
-	r.Key = string(kv[off : off+h.KeyLength])
+	kv, fields := kv[off:], kv[:off]
+	if h.Encrypted {
+		plaintext, err := Open(keys, kv, aad(header, fields))
+		if err != nil {
+			return err
+		}
+
+		kv = plaintext
+	}
+
+	r.Key = string(kv[:h.KeyLength])
 	r.Header = h
-	r.Value, err = snappy.Decode(nil, kv[off+h.KeyLength:])
+	r.Batch = h.Batch
+	if h.Pointer {
+		r.Value = nil
+		r.Pointer = &ValuePointer{}
+		return r.Pointer.Unmarshal(kv[h.KeyLength:])
+	}
+
+	if !h.codecField && h.DataLength == 0 {
+		r.Value = nil
+		return nil
+	}
+
+	codec, err := LookupCodec(h.Codec)
+	if err != nil {
+		return err
+	}
+
+	r.Value, err = codec.Decode(kv[h.KeyLength:])
+	if err == nil && r.Value == nil {
+		r.Value = []byte{}
+	}
+
 	return err
 }
 
+// aad returns the data a sealed record authenticates besides its key and
+// value: the header after the checksum and the fields of the body before
+// the key, but the LSN and time, which are set after sealing, see Stamp.
+func aad(header, fields []byte) []byte {
+	b := make([]byte, 0, len(header)-4+len(fields))
+	b = append(b, header[4:]...)
+	return append(b, fields...)
+}
+
+// Stamp sets the LSN and write time of the marshalled record b and updates
+// its checksum. Records are marshalled before their LSN is known, it is only
+// given out once their place in the log is.
+func Stamp(b []byte, lsn uint64, at time.Time) error {
+	if len(b) < HeaderSize+16 || b[4+1]&flagLSN == 0 || b[4+1]&flagTime == 0 {
+		return ErrNoLSN
+	}
+
+	binary.LittleEndian.PutUint64(b[HeaderSize:], lsn)
+	binary.LittleEndian.PutUint64(b[HeaderSize+8:], unixMilli(at))
+	binary.LittleEndian.PutUint32(b, crc32.Checksum(b[4:], crcTable))
+	return nil
+}
+
+// unixMilli returns t in milliseconds since the epoch, or zero for the zero
+// time.
+func unixMilli(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return uint64(t.UnixMilli())
+}
+
+// Verify checks the checksum of the marshalled record b. It returns
+// ErrChecksumMismatch when the record does not match it.
+func Verify(b []byte, f Format) error {
+	h, err := NewHeaderFormat(b, f)
+	if err != nil {
+		return err
+	}
+
+	end := f.HeaderSize() + h.BodySize()
+	if int64(len(b)) < end {
+		return io.ErrUnexpectedEOF
+	}
+
+	if f == FormatCRC32C {
+		if crc32.Checksum(b[4:end], crcTable) != h.Checksum {
+			return ErrChecksumMismatch
+		}
+
+		return nil
+	}
+
+	if h.DataLength == 0 {
+		return nil
+	}
+
+	sum := md5.Sum(b[end-int64(h.DataLength) : end])
+	if !bytes.Equal(sum[:], h.legacyChecksum) {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
 func (r Record) Size() int64 {
-	return r.Header.BodySize() + HeaderSize
+	return r.Header.BodySize() + r.Header.Format.HeaderSize()
+}
+
+// Tombstone reports whether the record marks its key as deleted.
+func (r Record) Tombstone() bool {
+	switch r.Header.Type {
+	case TypeDelete:
+		return true
+	case TypePersistence, TypeTTL:
+		return !r.Header.codecField && r.Header.DataLength == 0
+	default:
+		return false
+	}
 }
 
 func (r Record) Valid() bool {
-	if r.Header.DataLength == 0 {
+	if r.Tombstone() {
 		return false
 	}
 
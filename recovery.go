@@ -0,0 +1,90 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import "os"
+
+// RecoveryMode decides what opening a store does with a segment whose tail
+// cannot be read back, typically because the process died in the middle of a
+// write. Only the last segment can be torn that way, the others are synced
+// before the next one is started.
+type RecoveryMode int
+
+const (
+	// RecoveryRepair truncates the last segment back to its last good record
+	// and continues. A bad record in any other segment fails the open.
+	RecoveryRepair RecoveryMode = iota
+	// RecoveryLenient ignores everything from the bad record on, in any
+	// segment, but leaves the files as they are. Writes go to a new segment.
+	RecoveryLenient
+	// RecoveryStrict refuses to open the store.
+	RecoveryStrict
+)
+
+// RecoveryReport describes what was dropped while opening a store.
+type RecoveryReport struct {
+	// Segments lists the paths of the segments that had a bad tail.
+	Segments []string
+	// DroppedBytes is the number of bytes ignored or truncated.
+	DroppedBytes int64
+}
+
+// Recovery returns what was dropped while the store was opened.
+func (d *Daklak) Recovery() RecoveryReport {
+	return d.recovery
+}
+
+// recover applies the recovery mode to seg, whose records can only be read up
+// to the corruption. The caller must be opening the store.
+func (d *Daklak) recover(seg *segment, corruption *CorruptionError) error {
+	if d.opts.Recovery == RecoveryStrict || (d.opts.Recovery == RecoveryRepair && seg != d.active) {
+		return corruption
+	}
+
+	if d.opts.Recovery == RecoveryRepair && !d.opts.ReadOnly {
+		if err := os.Truncate(seg.path, corruption.Offset); err != nil {
+			return err
+		}
+
+		// A hint written before the tail was lost covers bytes that new
+		// records will overwrite.
+		if err := removeHint(d.path, seg.id); err != nil {
+			return err
+		}
+	}
+
+	dropped := seg.size - corruption.Offset
+	seg.size = corruption.Offset
+	d.recovery.Segments = append(d.recovery.Segments, seg.path)
+	d.recovery.DroppedBytes += dropped
+	d.logf("daklak: %v, dropped %d bytes", corruption, dropped)
+	return nil
+}
+
+func (d *Daklak) recovered(seg *segment) bool {
+	for _, path := range d.recovery.Segments {
+		if path == seg.path {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/phamvinhdat/daklak/record"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoveryRepairsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("a", []byte("1")))
+	require.NoError(t, d.Set("b", []byte("2")))
+	require.NoError(t, d.Close())
+
+	path := filepath.Join(dir, segmentName(0))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-3))
+
+	d = openTest(t, dir, testOptions())
+	requireValues(t, d, map[string]string{"a": "1"})
+	require.Equal(t, []string{path}, d.Recovery().Segments)
+	require.NoError(t, d.Set("c", []byte("3")))
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, testOptions())
+	defer d.Close()
+	requireValues(t, d, map[string]string{"a": "1", "c": "3"})
+	require.Empty(t, d.Recovery().Segments)
+}
+
+func TestRecoveryKeepsCorruptSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.SegmentSize = 200
+	d := openTest(t, dir, opts)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, d.Set(testKey(i), []byte("value")))
+	}
+	require.NoError(t, d.Close())
+
+	hints, err := filepath.Glob(filepath.Join(dir, "*"+hintExt))
+	require.NoError(t, err)
+	for _, hint := range hints {
+		require.NoError(t, os.Remove(hint))
+	}
+
+	path := filepath.Join(dir, segmentName(0))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b[segmentHeaderSize+record.HeaderSize] ^= 1
+	require.NoError(t, os.WriteFile(path, b, 0644))
+
+	for _, mode := range []RecoveryMode{RecoveryRepair, RecoveryStrict} {
+		opts.Recovery = mode
+		_, err = NewDaklakWithOptions(dir, opts)
+		require.True(t, errors.Is(err, ErrCorrupted), err)
+	}
+
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, b, after)
+
+	opts.Recovery = RecoveryLenient
+	d = openTest(t, dir, opts)
+	require.Equal(t, []string{path}, d.Recovery().Segments)
+	_, err = d.Get(testKey(19))
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	after, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, b, after)
+}
@@ -0,0 +1,384 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+type segment struct {
+	id      uint32
+	path    string
+	writer  *os.File
+	readers []*os.File
+	next    atomic.Uint32
+	size    int64
+
+	// header is the segment's file header, start the offset of its first
+	// record.
+	header segmentHeader
+	start  int64
+
+	// hinted is set while the hint file of the segment covers all of it.
+	hinted bool
+
+	// writes and syncs count the writes to the segment and the syncs of
+	// them.
+	writes atomic.Int64
+	syncs  atomic.Int64
+}
+
+func segmentName(id uint32) string {
+	return fmt.Sprintf("%09d%s", id, segmentExt)
+}
+
+// openSegment opens segment id of dir. A writable segment is created with
+// mode if it does not exist.
+func openSegment(dir string, id uint32, writable bool, readHandles int, mode os.FileMode) (*segment, error) {
+	return openSegmentFile(filepath.Join(dir, segmentName(id)), id, writable, readHandles, mode)
+}
+
+func openSegmentFile(path string, id uint32, writable bool, readHandles int, mode os.FileMode) (*segment, error) {
+	s := &segment{
+		id:   id,
+		path: path,
+	}
+
+	if writable {
+		writer, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
+		if err != nil {
+			return nil, err
+		}
+
+		s.writer = writer
+	}
+
+	if err := s.openReaders(readHandles); err != nil {
+		_ = s.close()
+		return nil, err
+	}
+
+	info, err := s.readers[0].Stat()
+	if err != nil {
+		_ = s.close()
+		return nil, err
+	}
+
+	s.size = info.Size()
+	if err = s.readHeader(); err != nil {
+		_ = s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// openTempSegment creates a writable segment under a temporary name, see
+// commit.
+func openTempSegment(dir string, id uint32, readHandles int, mode os.FileMode) (*segment, error) {
+	s := &segment{
+		id:   id,
+		path: filepath.Join(dir, segmentName(id)+tmpExt),
+	}
+
+	writer, err := os.OpenFile(s.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	s.writer = writer
+	if err = s.openReaders(readHandles); err != nil {
+		_ = s.close()
+		return nil, err
+	}
+
+	if err = s.writeHeader(newSegmentHeader()); err != nil {
+		_ = s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// readHeader reads the header of the segment. A writable segment that is new,
+// or whose header was torn, gets a fresh one. Legacy segments have no header
+// and their records start at offset 0.
+func (s *segment) readHeader() error {
+	b := make([]byte, min(s.size, segmentHeaderSize))
+	if err := s.readAt(b, 0); err != nil {
+		return err
+	}
+
+	switch {
+	case len(b) > 0 && !hasMagic(b):
+		s.header = segmentHeader{version: formatLegacy}
+		return nil
+	case len(b) < segmentHeaderSize && s.writer != nil:
+		if err := s.truncate(0); err != nil {
+			return err
+		}
+
+		return s.writeHeader(newSegmentHeader())
+	case len(b) < segmentHeaderSize:
+		// A sealed segment that never got a record.
+		s.header = newSegmentHeader()
+		s.start = s.size
+		return nil
+	}
+
+	if err := s.header.unmarshal(b); err != nil {
+		return &CorruptionError{Path: s.path, Err: err}
+	}
+
+	if s.header.version > formatVersion {
+		return &VersionError{Path: s.path, Version: s.header.version}
+	}
+
+	if s.header.flags&^segmentFlags != 0 {
+		return fmt.Errorf("%w: %s has unknown flags %#x", ErrUnsupportedVersion, s.path, s.header.flags)
+	}
+
+	s.start = segmentHeaderSize
+	return nil
+}
+
+func (s *segment) writeHeader(h segmentHeader) error {
+	if _, err := s.write(h.marshal()); err != nil {
+		return err
+	}
+
+	s.header = h
+	s.start = segmentHeaderSize
+	return nil
+}
+
+func (s *segment) format() record.Format {
+	return recordFormat(s.header.version)
+}
+
+// empty reports whether the segment holds no record.
+func (s *segment) empty() bool {
+	return s.size <= s.start
+}
+
+func (s *segment) openReaders(n int) error {
+	if n < 1 {
+		n = 1
+	}
+
+	for i := 0; i < n; i++ {
+		reader, err := os.Open(s.path)
+		if err != nil {
+			return err
+		}
+
+		s.readers = append(s.readers, reader)
+	}
+
+	return nil
+}
+
+// readAt fills b from offset off. Reads never move a file position, so any
+// number of them can run at once; they are spread over the reader handles.
+func (s *segment) readAt(b []byte, off int64) error {
+	reader := s.readers[s.next.Add(1)%uint32(len(s.readers))]
+	n, err := reader.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// commit moves a segment created by openTempSegment to its final name.
+func (s *segment) commit(dir string) error {
+	path := filepath.Join(dir, segmentName(s.id))
+	if err := os.Rename(s.path, path); err != nil {
+		return err
+	}
+
+	s.path = path
+	return nil
+}
+
+func (s *segment) write(b []byte) (int, error) {
+	n, err := s.writer.Write(b)
+	s.writes.Add(1)
+	s.size += int64(n)
+	s.hinted = false
+	return n, err
+}
+
+// truncate cuts the segment back to size, dropping a partially written tail.
+func (s *segment) truncate(size int64) error {
+	if err := s.writer.Truncate(size); err != nil {
+		return err
+	}
+
+	s.size = size
+	return nil
+}
+
+// seal flushes the segment and closes its writer, the segment stays readable.
+func (s *segment) seal() error {
+	if s.writer == nil {
+		return nil
+	}
+
+	if err := s.sync(); err != nil {
+		return err
+	}
+
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
+
+func (s *segment) sync() error {
+	if err := s.writer.Sync(); err != nil {
+		return err
+	}
+
+	s.syncs.Add(1)
+	return nil
+}
+
+func (s *segment) close() error {
+	var returnErr error
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			returnErr = err
+		}
+	}
+
+	for _, reader := range s.readers {
+		if err := reader.Close(); err != nil {
+			returnErr = err
+		}
+	}
+
+	return returnErr
+}
+
+// listSegments returns the ids of the segment files in dir in ascending order.
+func listSegments(dir string) ([]uint32, error) {
+	return listFiles(dir, segmentExt)
+}
+
+// listFiles returns the ids of the files named after an id with extension
+// ext in dir, in ascending order.
+func listFiles(dir, ext string) ([]uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ext) || name == dataFile {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// tidyDir prepares the store directory for opening: the data file of older
+// versions becomes the first segment and the leftovers of an unfinished
+// merge are removed.
+func tidyDir(dir string) error {
+	if err := adoptLegacyFile(dir); err != nil {
+		return err
+	}
+
+	return removeTempFiles(dir)
+}
+
+// hasLegacyFile reports whether dir holds the single data file written by
+// older versions.
+func hasLegacyFile(dir string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(dir, dataFile)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, segmentName(0))); err == nil {
+		return false, fmt.Errorf("both %s and %s exist in %s", dataFile, segmentName(0), dir)
+	}
+
+	return true, nil
+}
+
+// adoptLegacyFile turns the single data file written by older versions into
+// the first segment.
+func adoptLegacyFile(dir string) error {
+	legacy, err := hasLegacyFile(dir)
+	if err != nil || !legacy {
+		return err
+	}
+
+	return os.Rename(filepath.Join(dir, dataFile), filepath.Join(dir, segmentName(0)))
+}
+
+// removeTempFiles deletes the leftovers of a merge that did not complete.
+func removeTempFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), tmpExt) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -27,6 +27,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/tidwall/match"
 	"github.com/tidwall/redcon"
 
 	"github.com/phamvinhdat/daklak"
@@ -111,9 +112,9 @@ func handler(db *daklak.Daklak) func(redcon.Conn, redcon.Command) {
 			if pattern == "*" {
 				n := 0
 				var raw []byte
-				daklak.MapKeys().Range(func(key, _ any) bool {
+				db.Range(func(key string) bool {
 					n++
-					raw = redcon.AppendBulk(raw, []byte(key.(string)))
+					raw = redcon.AppendBulk(raw, []byte(key))
 					return true
 				})
 
@@ -122,7 +123,18 @@ func handler(db *daklak.Daklak) func(redcon.Conn, redcon.Command) {
 				return
 			}
 
-			conn.WriteArray(0)
+			var keys []string
+			it := db.NewIterator(daklak.IteratorOptions{Prefix: globPrefix(pattern)})
+			for ; it.Valid(); it.Next() {
+				if match.Match(it.Key(), pattern) {
+					keys = append(keys, it.Key())
+				}
+			}
+
+			conn.WriteArray(len(keys))
+			for _, key := range keys {
+				conn.WriteBulkString(key)
+			}
 		case "del":
 			if len(cmd.Args) != 2 {
 				conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
@@ -140,6 +152,88 @@ func handler(db *daklak.Daklak) func(redcon.Conn, redcon.Command) {
 				return
 			}
 
+			conn.WriteInt(1)
+		case "ttl", "pttl":
+			if len(cmd.Args) != 2 {
+				conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+				return
+			}
+
+			ttl, err := db.TTL(string(cmd.Args[1]))
+			if err != nil {
+				if !errors.Is(err, daklak.ErrResourceNotFound) {
+					conn.WriteError(err.Error())
+					return
+				}
+
+				conn.WriteInt(-2)
+				return
+			}
+
+			switch {
+			case ttl < 0:
+				conn.WriteInt(-1)
+			case cmdStr == "ttl":
+				conn.WriteInt64(int64((ttl + time.Second/2) / time.Second))
+			default:
+				conn.WriteInt64(ttl.Milliseconds())
+			}
+		case "expire", "pexpire", "expireat":
+			if len(cmd.Args) != 3 {
+				conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+				return
+			}
+
+			n, err := strconv.ParseInt(string(cmd.Args[2]), 10, 64)
+			if err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+
+			var at time.Time
+			switch cmdStr {
+			case "expire":
+				at = time.Now().Add(time.Duration(n) * time.Second)
+			case "pexpire":
+				at = time.Now().Add(time.Duration(n) * time.Millisecond)
+			default:
+				at = time.Unix(n, 0)
+			}
+
+			if err = db.ExpireAt(string(cmd.Args[1]), at); err != nil {
+				if !errors.Is(err, daklak.ErrResourceNotFound) {
+					conn.WriteError(err.Error())
+					return
+				}
+
+				conn.WriteInt(0)
+				return
+			}
+
+			conn.WriteInt(1)
+		case "persist":
+			if len(cmd.Args) != 2 {
+				conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+				return
+			}
+
+			key := string(cmd.Args[1])
+			ttl, err := db.TTL(key)
+			if err != nil || ttl < 0 {
+				if err != nil && !errors.Is(err, daklak.ErrResourceNotFound) {
+					conn.WriteError(err.Error())
+					return
+				}
+
+				conn.WriteInt(0)
+				return
+			}
+
+			if err = db.Persist(key); err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+
 			conn.WriteInt(1)
 			//case "publish":
 			//	if len(cmd.Args) != 3 {
@@ -164,6 +258,16 @@ func handler(db *daklak.Daklak) func(redcon.Conn, redcon.Command) {
 	}
 }
 
+// globPrefix returns the literal part of a glob pattern before its first
+// special character.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+
+	return pattern
+}
+
 func isAccepted(conn redcon.Conn) bool {
 	// Use this function to accept or deny the connection.
 	log.Printf("accept: %s", conn.RemoteAddr())
@@ -0,0 +1,124 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	opts := testOptions()
+	opts.SyncMode = SyncAlways
+	d := openTest(t, t.TempDir(), opts)
+	defer d.Close()
+
+	// Writers queue up behind the lock, the first to get it writes for all
+	// of them.
+	const writers = 8
+	var wg sync.WaitGroup
+	d.mu.Lock()
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, d.Set(testKey(i), []byte("v")))
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		d.pendingMu.Lock()
+		defer d.pendingMu.Unlock()
+		return len(d.pending) == writers
+	}, 5*time.Second, time.Millisecond)
+	writes, syncs := d.active.writes.Load(), d.active.syncs.Load()
+	d.mu.Unlock()
+	wg.Wait()
+
+	require.Equal(t, writes+1, d.active.writes.Load())
+	require.Equal(t, syncs+1, d.active.syncs.Load())
+	want := make(map[string]string)
+	for i := 0; i < writers; i++ {
+		want[testKey(i)] = "v"
+	}
+	requireValues(t, d, want)
+}
+
+func TestSyncModes(t *testing.T) {
+	t.Run("always", func(t *testing.T) {
+		opts := testOptions()
+		opts.SyncMode = SyncAlways
+		d := openTest(t, t.TempDir(), opts)
+		defer d.Close()
+
+		for i := 0; i < 3; i++ {
+			syncs := d.active.syncs.Load()
+			require.NoError(t, d.Set(testKey(i), []byte("v")))
+			require.Equal(t, syncs+1, d.active.syncs.Load())
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		opts := testOptions()
+		opts.SyncMode = SyncInterval
+		opts.SyncInterval = 20 * time.Millisecond
+		d := openTest(t, t.TempDir(), opts)
+		defer d.Close()
+
+		syncs := d.active.syncs.Load()
+		require.NoError(t, d.Set("a", []byte("v")))
+		require.Eventually(t, func() bool {
+			return d.active.syncs.Load() > syncs
+		}, 5*time.Second, 5*time.Millisecond)
+
+		// Batches are synced before Write returns.
+		syncs = d.active.syncs.Load()
+		b := NewBatch()
+		b.Set("b", []byte("v"))
+		require.NoError(t, d.Write(b))
+		require.Greater(t, d.active.syncs.Load(), syncs)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		opts := testOptions()
+		opts.SyncMode = SyncNone
+		opts.SyncInterval = 0
+		d := openTest(t, t.TempDir(), opts)
+		defer d.Close()
+
+		syncs := d.active.syncs.Load()
+		require.NoError(t, d.Set("a", []byte("v")))
+		b := NewBatch()
+		b.Set("b", []byte("v"))
+		require.NoError(t, d.Write(b))
+		time.Sleep(50 * time.Millisecond)
+		require.Equal(t, syncs, d.active.syncs.Load())
+	})
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		opts := testOptions()
+		opts.SyncMode = SyncInterval
+		opts.SyncInterval = interval
+		_, err := NewDaklakWithOptions(t.TempDir(), opts)
+		require.ErrorIs(t, err, ErrInvalidOptions)
+	}
+}
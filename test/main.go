@@ -44,8 +44,13 @@ func main() {
 		panic(err)
 	}
 
-	daklak.MapKeys().Range(func(key, value any) bool {
-		fmt.Printf("key: %s, value: %v\n", key, value)
+	d.Range(func(key string) bool {
+		value, err := d.Get(key)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("key: %s, value: %s\n", key, value)
 		return true
 	})
 }
@@ -0,0 +1,70 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"time"
+)
+
+// TTL returns how long key has left to live, or -1 when it does not expire.
+func (d *Daklak) TTL(key string) (time.Duration, error) {
+	now := time.Now()
+	e, ok := d.keys.Get(key)
+	if !ok || e.expired(now) {
+		return 0, ErrResourceNotFound
+	}
+
+	if e.expiresAt == 0 {
+		return -1, nil
+	}
+
+	return time.UnixMilli(e.expiresAt).Sub(now), nil
+}
+
+// Expire makes key expire after ttl. A ttl that is not positive expires it
+// right away.
+func (d *Daklak) Expire(key string, ttl time.Duration) error {
+	return d.ExpireAt(key, time.Now().Add(ttl))
+}
+
+// ExpireAt makes key expire at t. A t that is not in the future deletes it.
+func (d *Daklak) ExpireAt(key string, t time.Time) error {
+	if _, err := d.TTL(key); err != nil {
+		return err
+	}
+
+	if !t.After(time.Now()) {
+		// An expiry record at the epoch would read back as no expiry.
+		return d.commit(newDelete(key))
+	}
+
+	return d.commit(newExpire(key, &t))
+}
+
+// Persist removes the expiry of key.
+func (d *Daklak) Persist(key string) error {
+	ttl, err := d.TTL(key)
+	if err != nil || ttl < 0 {
+		return err
+	}
+
+	return d.commit(newExpire(key, nil))
+}
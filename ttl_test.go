@@ -0,0 +1,134 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTL(t *testing.T) {
+	for _, hints := range []bool{true, false} {
+		dir := t.TempDir()
+		opts := testOptions()
+		opts.SegmentSize = 200
+		d := openTest(t, dir, opts)
+
+		require.NoError(t, d.SetEx("a", []byte("va"), 100*time.Millisecond))
+		require.NoError(t, d.Set("b", []byte("vb")))
+		require.NoError(t, d.Set("c", []byte("vc")))
+		for i := 0; i < 20; i++ {
+			require.NoError(t, d.Set(testKey(i), []byte("padding")))
+		}
+
+		require.NoError(t, d.Persist("a"))
+		ttl, err := d.TTL("a")
+		require.NoError(t, err)
+		require.Equal(t, time.Duration(-1), ttl)
+
+		require.NoError(t, d.Expire("b", 100*time.Millisecond))
+		require.NoError(t, d.Expire("c", time.Hour))
+		require.Equal(t, ErrResourceNotFound, d.Expire("missing", time.Hour))
+		time.Sleep(200 * time.Millisecond)
+
+		check := func() {
+			value, err := d.Get("a")
+			require.NoError(t, err)
+			require.Equal(t, "va", string(value))
+			_, err = d.Get("b")
+			require.Equal(t, ErrResourceNotFound, err)
+			ttl, err := d.TTL("c")
+			require.NoError(t, err)
+			require.Greater(t, ttl, 59*time.Minute)
+		}
+		check()
+		require.NoError(t, d.Close())
+
+		if !hints {
+			paths, err := filepath.Glob(filepath.Join(dir, "*"+hintExt))
+			require.NoError(t, err)
+			for _, path := range paths {
+				require.NoError(t, os.Remove(path))
+			}
+		}
+
+		d = openTest(t, dir, opts)
+		check()
+		require.NoError(t, d.Merge())
+		check()
+		require.NoError(t, d.Close())
+
+		d = openTest(t, dir, opts)
+		check()
+		require.NoError(t, d.Close())
+	}
+}
+
+func TestExpireAtPast(t *testing.T) {
+	dir := t.TempDir()
+	d := openTest(t, dir, testOptions())
+	require.NoError(t, d.Set("epoch", []byte("v")))
+	require.NoError(t, d.Set("past", []byte("v")))
+	require.NoError(t, d.ExpireAt("epoch", time.Unix(0, 0)))
+	require.NoError(t, d.Expire("past", -time.Second))
+
+	for _, key := range []string{"epoch", "past"} {
+		_, err := d.Get(key)
+		require.Equal(t, ErrResourceNotFound, err, key)
+	}
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, testOptions())
+	defer d.Close()
+	requireValues(t, d, map[string]string{})
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.SweepInterval = 10 * time.Millisecond
+	opts.SweepLimit = 10
+	d := openTest(t, dir, opts)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, d.SetEx(testKey(i), []byte("v"), 20*time.Millisecond))
+	}
+	require.NoError(t, d.SetEx("long", []byte("v"), time.Hour))
+	require.NoError(t, d.SetEx(testKey(5), []byte("v"), time.Hour))
+	require.NoError(t, d.Set(testKey(6), []byte("v")))
+
+	want := map[string]string{"long": "v", testKey(5): "v", testKey(6): "v"}
+	require.Eventually(t, func() bool {
+		return d.keys.Len() == len(want)
+	}, 5*time.Second, 10*time.Millisecond)
+	requireValues(t, d, want)
+	require.NoError(t, d.Close())
+
+	// The sweeper wrote tombstones, so the keys stay gone without it.
+	opts.SweepInterval = 0
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	require.Equal(t, 3, d.keys.Len())
+	requireValues(t, d, want)
+}
@@ -0,0 +1,503 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// valueLog holds values written apart from their keys, see
+// Options.ValueThreshold. Its records hold the key and the value; the record
+// in the segments holds the key, the expiry and a pointer to the value.
+type valueLog struct {
+	*segment
+
+	// dead counts the bytes of the values no key points at anymore.
+	dead atomic.Int64
+	// keyIDs holds the ids of the keys its records are encrypted under, nil
+	// until they are read. It is guarded by Daklak.vlogMu.
+	keyIDs map[uint32]struct{}
+}
+
+// valueMove records where CollectValueLogs copied a live value to.
+type valueMove struct {
+	key      string
+	from, to record.ValuePointer
+}
+
+func valueLogName(id uint32) string {
+	return fmt.Sprintf("%09d%s", id, valueLogExt)
+}
+
+func openValueLog(dir string, id uint32, writable bool, readHandles int, mode os.FileMode) (*valueLog, error) {
+	seg, err := openSegmentFile(filepath.Join(dir, valueLogName(id)), id, writable, readHandles, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &valueLog{segment: seg}, nil
+}
+
+// openValueLogs opens the value logs of the store for reading and counts
+// their garbage from the index. Values are never appended to a value log of
+// an earlier open, its tail may be torn.
+func (d *Daklak) openValueLogs() error {
+	ids, err := listFiles(d.path, valueLogExt)
+	if err != nil {
+		return err
+	}
+
+	next, _, err := readNumber(filepath.Join(d.path, valueLogIDFile))
+	if err != nil {
+		return err
+	}
+
+	// Stores written before the id was kept only know about the value logs
+	// left and the ones the index points into.
+	d.nextVlog = uint32(next)
+	live := make(map[uint32]int64)
+	d.keys.Iterate(func(_ string, e entry) bool {
+		if e.value != nil {
+			live[e.value.File] += e.value.Size
+			d.nextVlog = max(d.nextVlog, e.value.File+1)
+		}
+
+		return true
+	})
+
+	for _, id := range ids {
+		vl, err := openValueLog(d.path, id, false, d.opts.ReadHandles, d.opts.FileMode)
+		if err != nil {
+			return err
+		}
+
+		vl.dead.Store(vl.size - vl.start - live[id])
+		d.vlogs[id] = vl
+		d.nextVlog = max(d.nextVlog, id+1)
+	}
+
+	return nil
+}
+
+// separate reports whether the value of o goes to a value log.
+func (d *Daklak) separate(o op) bool {
+	return d.opts.ValueThreshold > 0 && !o.tombstone && !o.expire && !o.marker &&
+		o.r.Pointer == nil && len(o.r.Value) >= d.opts.ValueThreshold
+}
+
+// writeValue appends the key and value of r to the active value log and
+// returns where they were written. lsn is at most the LSN of the record that
+// will point to the value.
+func (d *Daklak) writeValue(r *record.Record, lsn uint64) (*record.ValuePointer, error) {
+	b, err := (&record.Record{Key: r.Key, Value: r.Value, LSN: lsn}).MarshalWith(d.opts.Compression, d.opts.KeyProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	d.vlogMu.Lock()
+	defer d.vlogMu.Unlock()
+	if d.vlog == nil || (!d.vlog.empty() && d.vlog.size+int64(len(b)) > d.opts.ValueLogSize) {
+		if err = d.rotateValueLog(); err != nil {
+			return nil, err
+		}
+	}
+
+	offset := d.vlog.size
+	if _, err = d.vlog.write(b); err != nil {
+		if truncErr := d.vlog.truncate(offset); truncErr != nil {
+			d.logf("daklak: truncate %s after failed write: %v", d.vlog.path, truncErr)
+		}
+
+		return nil, err
+	}
+
+	if id, ok, _ := record.KeyID(b); ok {
+		d.vlog.keyIDs[id] = struct{}{}
+	}
+
+	return &record.ValuePointer{File: d.vlog.id, Offset: offset, Size: int64(len(b))}, nil
+}
+
+// rotateValueLog seals the active value log and opens a new one with the
+// next id. The id is kept on disk first, so it is not given again once the
+// value log is collected. The caller must hold d.vlogMu.
+func (d *Daklak) rotateValueLog() error {
+	if d.vlog != nil {
+		if err := d.vlog.seal(); err != nil {
+			return err
+		}
+	}
+
+	id := d.nextVlog
+	if err := writeNumber(filepath.Join(d.path, valueLogIDFile), uint64(id)+1, d.opts.FileMode); err != nil {
+		return err
+	}
+
+	d.nextVlog++
+	d.segMu.Lock()
+	defer d.segMu.Unlock()
+	vl, err := openValueLog(d.path, id, true, d.opts.ReadHandles, d.opts.FileMode)
+	if err != nil {
+		return err
+	}
+
+	vl.keyIDs = make(map[uint32]struct{})
+	d.vlogs[id] = vl
+	d.vlog = vl
+	return nil
+}
+
+// syncValueLog flushes the active value log.
+func (d *Daklak) syncValueLog() error {
+	d.vlogMu.Lock()
+	var writer *os.File
+	if d.vlog != nil {
+		writer = d.vlog.writer
+	}
+	d.vlogMu.Unlock()
+
+	if writer == nil {
+		return nil
+	}
+
+	// A value log rotated away in the meantime was synced when sealed.
+	if err := writer.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// readValue reads the value of key at p for the record with the given LSN.
+// The caller must hold d.segMu.
+func (d *Daklak) readValue(key string, lsn uint64, p record.ValuePointer) ([]byte, error) {
+	vl, ok := d.vlogs[p.File]
+	if !ok {
+		return nil, &CorruptionError{Path: filepath.Join(d.path, valueLogName(p.File)), Offset: p.Offset, Err: os.ErrNotExist}
+	}
+
+	b := make([]byte, p.Size)
+	if err := vl.readAt(b, p.Offset); err != nil {
+		return nil, err
+	}
+
+	return d.decodeValue(b, vl.path, vl.format(), key, lsn, p)
+}
+
+// decodeValue decodes the value of key read at p from the value log at path.
+// A value written after the record with the given LSN, or for another key,
+// took the place of the one the record points to.
+func (d *Daklak) decodeValue(b []byte, path string, f record.Format, key string, lsn uint64, p record.ValuePointer) ([]byte, error) {
+	if d.opts.VerifyChecksums {
+		if err := record.Verify(b, f); err != nil {
+			return nil, &CorruptionError{Path: path, Offset: p.Offset, Err: err}
+		}
+	}
+
+	r := &record.Record{}
+	if err := r.UnmarshalFormat(b, f, d.opts.KeyProvider); err != nil {
+		return nil, &CorruptionError{Path: path, Offset: p.Offset, Err: err}
+	}
+
+	if r.Key != key || (lsn != 0 && r.LSN > lsn) {
+		return nil, &CorruptionError{Path: path, Offset: p.Offset, Err: record.ErrInvalidPointer}
+	}
+
+	return r.Value, nil
+}
+
+// releaseValue counts the value at p as garbage. The caller must hold
+// d.segMu.
+func (d *Daklak) releaseValue(p record.ValuePointer) {
+	if vl, ok := d.vlogs[p.File]; ok {
+		vl.dead.Add(p.Size)
+	}
+}
+
+// discardValues counts the values written for ops that did not make it to a
+// segment as garbage.
+func (d *Daklak) discardValues(ops []op) {
+	d.segMu.RLock()
+	defer d.segMu.RUnlock()
+	for _, o := range ops {
+		if o.value != nil {
+			d.releaseValue(*o.value)
+		}
+	}
+}
+
+// CollectValueLogs rewrites the sealed value logs whose share of garbage
+// reached Options.ValueLogGCRatio: the values still in use are copied to the
+// active value log, their keys are pointed at the copies and the old file is
+// removed. Value logs holding values encrypted under another key than the
+// current one are rewritten whatever their garbage, so a rotated out key is
+// no longer needed once Merge and CollectValueLogs have run. Like Merge, it
+// runs alongside reads and writes and fails with ErrMergeInProgress while a
+// merge runs.
+func (d *Daklak) CollectValueLogs() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if !d.merging.CompareAndSwap(false, true) {
+		return ErrMergeInProgress
+	}
+	defer d.merging.Store(false)
+
+	logs, err := d.collectable()
+	if err != nil {
+		return err
+	}
+
+	for _, vl := range logs {
+		if err := d.collectValueLog(vl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectable returns the value logs CollectValueLogs should rewrite. It
+// seals the active value log when it holds values under an old key.
+func (d *Daklak) collectable() ([]*valueLog, error) {
+	d.vlogMu.Lock()
+	defer d.vlogMu.Unlock()
+
+	var current *uint32
+	if d.opts.KeyProvider != nil {
+		id, _, err := d.opts.KeyProvider.Current()
+		if err != nil {
+			return nil, err
+		}
+
+		current = &id
+	}
+
+	if d.vlog != nil && current != nil && d.vlog.stale(*current) {
+		if err := d.rotateValueLog(); err != nil {
+			return nil, err
+		}
+	}
+
+	d.segMu.RLock()
+	defer d.segMu.RUnlock()
+	var logs []*valueLog
+	for _, vl := range d.vlogs {
+		if vl == d.vlog {
+			continue
+		}
+
+		total := vl.size - vl.start
+		if total <= 0 || float64(vl.dead.Load())/float64(total) >= d.opts.ValueLogGCRatio {
+			logs = append(logs, vl)
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		if vl.keyIDs == nil {
+			ids, err := vl.readKeyIDs()
+			if err != nil {
+				return nil, err
+			}
+
+			vl.keyIDs = ids
+		}
+
+		if vl.stale(*current) {
+			logs = append(logs, vl)
+		}
+	}
+
+	sort.Slice(logs, func(i, j int) bool { return logs[i].id < logs[j].id })
+	return logs, nil
+}
+
+// stale reports whether vl holds values encrypted under another key than
+// current. The caller must hold d.vlogMu.
+func (vl *valueLog) stale(current uint32) bool {
+	for id := range vl.keyIDs {
+		if id != current {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readKeyIDs returns the ids of the keys the records of vl are encrypted
+// under, reading only their headers. A torn tail ends the walk.
+func (vl *valueLog) readKeyIDs() (map[uint32]struct{}, error) {
+	var (
+		ids = make(map[uint32]struct{})
+		b   = make([]byte, record.KeyIDPrefixSize)
+	)
+	for offset := vl.start; offset < vl.size; {
+		n := min(int64(len(b)), vl.size-offset)
+		if err := vl.readAt(b[:n], offset); err != nil {
+			return nil, err
+		}
+
+		h, err := record.NewHeader(b[:n])
+		if err != nil {
+			break
+		}
+
+		id, ok, err := record.KeyID(b[:n])
+		if err != nil {
+			break
+		}
+
+		if ok {
+			ids[id] = struct{}{}
+		}
+
+		offset += record.HeaderSize + h.BodySize()
+	}
+
+	return ids, nil
+}
+
+func (d *Daklak) collectValueLog(vl *valueLog) error {
+	var (
+		moves []valueMove
+		now   = time.Now()
+	)
+	err := scanSegment(vl.segment, d.opts.KeyProvider, vl.start, vl.size, func(r *record.Record, _ []byte, offset int64) error {
+		from := record.ValuePointer{File: vl.id, Offset: offset, Size: r.Size()}
+		if e, ok := d.keys.Get(r.Key); !ok || e.value == nil || *e.value != from || e.expired(now) {
+			return nil
+		}
+
+		to, err := d.writeValue(r, r.LSN)
+		if err != nil {
+			return err
+		}
+
+		moves = append(moves, valueMove{key: r.Key, from: from, to: *to})
+		return nil
+	})
+
+	var corruption *CorruptionError
+	if errors.As(err, &corruption) && !d.pointsPast(vl.id, corruption.Offset) {
+		// A tail torn by a crash, no key points at it.
+		err = nil
+	}
+
+	if err == nil {
+		err = d.syncValueLog()
+	}
+
+	if err != nil {
+		d.discardMoves(moves)
+		return err
+	}
+
+	if err = d.relocate(moves); err != nil {
+		return err
+	}
+
+	d.segMu.Lock()
+	delete(d.vlogs, vl.id)
+	d.segMu.Unlock()
+
+	if err = vl.close(); err != nil {
+		return err
+	}
+
+	return os.Remove(vl.path)
+}
+
+// relocate points the keys of moves that still use the old copy of their
+// value at the new one. The check and the write happen under d.mu so no write
+// to the keys can slip in between. The records are synced before the old
+// copies go away.
+func (d *Daklak) relocate(moves []valueMove) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ops []op
+	for _, mv := range moves {
+		cur, ok := d.keys.Get(mv.key)
+		if !ok || cur.value == nil || *cur.value != mv.from {
+			d.discardMoves([]valueMove{mv})
+			continue
+		}
+
+		to := mv.to
+		r := &record.Record{Key: mv.key, Pointer: &to}
+		if cur.expiresAt != 0 {
+			t := time.UnixMilli(cur.expiresAt)
+			r.ExpiatedAt = &t
+		}
+
+		// A move is not a write to the key, it keeps its LSN.
+		o := newPut(r)
+		o.lsn = cur.lsn
+		ops = append(ops, o)
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	if err := d.encode(ops); err != nil {
+		return err
+	}
+
+	if err := d.writeGroup([]*writeRequest{{ops: ops}}); err != nil {
+		d.discardValues(ops)
+		return err
+	}
+
+	return d.active.sync()
+}
+
+// pointsPast reports whether a key uses a value of value log id at or after
+// offset.
+func (d *Daklak) pointsPast(id uint32, offset int64) bool {
+	var found bool
+	d.keys.Iterate(func(_ string, e entry) bool {
+		found = e.value != nil && e.value.File == id && e.value.Offset >= offset
+		return !found
+	})
+
+	return found
+}
+
+func (d *Daklak) discardMoves(moves []valueMove) {
+	d.segMu.RLock()
+	defer d.segMu.RUnlock()
+	for _, mv := range moves {
+		d.releaseValue(mv.to)
+	}
+}
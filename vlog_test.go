@@ -0,0 +1,274 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package daklak
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func randomValue(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// valueLogsSize returns the size of the value logs of the store in dir.
+func valueLogsSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+valueLogExt))
+	require.NoError(t, err)
+
+	var size int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		size += info.Size()
+	}
+
+	return size
+}
+
+func TestValueLog(t *testing.T) {
+	indexes := map[string]IndexType{"hash": IndexHash, "btree": IndexBTree}
+	for _, encrypted := range []bool{false, true} {
+		for name, index := range indexes {
+			if encrypted {
+				name += "/encrypted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				dir := t.TempDir()
+				opts := testOptions()
+				opts.Index = index
+				opts.ValueThreshold = 1000
+				opts.ValueLogSize = 100 << 10
+				if encrypted {
+					opts.KeyProvider = keyRing(t, 1)
+				}
+
+				d := openTest(t, dir, opts)
+				want := map[string]string{}
+				for i := 0; i < 200; i++ {
+					key := testKey(i % 20)
+					value := randomValue(500+i*37%5000, int64(i))
+					switch {
+					case i%3 == 0:
+						b := NewBatch()
+						b.Set(key, value)
+						b.Set("small-"+key, []byte("x"))
+						require.NoError(t, d.Write(b))
+						want["small-"+key] = "x"
+					case i%7 == 0:
+						require.NoError(t, d.SetEx(key, value, time.Hour))
+					default:
+						require.NoError(t, d.Set(key, value))
+					}
+					want[key] = string(value)
+				}
+				require.NoError(t, d.Delete(testKey(5)))
+				delete(want, testKey(5))
+				requireValues(t, d, want)
+
+				require.NoError(t, d.Merge())
+				requireValues(t, d, want)
+				require.NoError(t, d.Close())
+
+				d = openTest(t, dir, opts)
+				before := valueLogsSize(t, dir)
+				require.NoError(t, d.CollectValueLogs())
+				requireValues(t, d, want)
+				require.Less(t, valueLogsSize(t, dir), before)
+				require.NoError(t, d.Close())
+
+				hints, err := filepath.Glob(filepath.Join(dir, "*"+hintExt))
+				require.NoError(t, err)
+				for _, hint := range hints {
+					require.NoError(t, os.Remove(hint))
+				}
+
+				d = openTest(t, dir, opts)
+				defer d.Close()
+				requireValues(t, d, want)
+				require.NoError(t, d.CollectValueLogs())
+				requireValues(t, d, want)
+			})
+		}
+	}
+}
+
+func TestValueLogCollectConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.ValueThreshold = 100
+	opts.ValueLogSize = 8 << 10
+	d := openTest(t, dir, opts)
+
+	value := func(key string, i int) []byte {
+		return append([]byte(key+":"), randomValue(200, int64(i))...)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3000; i++ {
+			key := testKey(i % 30)
+			if err := d.Set(key, value(key, i)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	check := func(d *Daklak) {
+		for i := 0; i < 30; i++ {
+			key := testKey(i)
+			v, err := d.Get(key)
+			if err == ErrResourceNotFound {
+				continue
+			}
+
+			require.NoError(t, err, key)
+			require.True(t, bytes.HasPrefix(v, []byte(key+":")), key)
+		}
+	}
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		require.NoError(t, d.CollectValueLogs())
+		require.NoError(t, d.Merge())
+		check(d)
+	}
+
+	want := map[string]string{}
+	for i := 3000 - 30; i < 3000; i++ {
+		want[testKey(i%30)] = string(value(testKey(i%30), i))
+	}
+	requireValues(t, d, want)
+	require.NoError(t, d.CollectValueLogs())
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	requireValues(t, d, want)
+}
+
+func TestValueLogIDsNotReused(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.ValueThreshold = 16
+	d := openTest(t, dir, opts)
+	require.NoError(t, d.Set("k", bytes.Repeat([]byte("A"), 64)))
+	lsn := d.LSN()
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, opts)
+	require.NoError(t, d.Set("k", []byte("small")))
+	require.NoError(t, d.CollectValueLogs())
+	require.NoError(t, d.Close())
+	_, err := os.Stat(filepath.Join(dir, valueLogName(0)))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	d = openTest(t, dir, opts)
+	require.NoError(t, d.Set("k", bytes.Repeat([]byte("C"), 64)))
+	_, err = os.Stat(filepath.Join(dir, valueLogName(0)))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// The record of A still points into the collected value log.
+	recovered := recoverTest(t, d, PointInTime{LSN: lsn})
+	requireValues(t, recovered, map[string]string{})
+	require.NoError(t, recovered.Close())
+	require.NoError(t, d.Set("k", []byte("small")))
+	require.NoError(t, d.Close())
+
+	// A restored store goes on from the same id.
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	require.NoError(t, d.CollectValueLogs())
+	backup := filepath.Join(t.TempDir(), "backup")
+	_, err = d.BackupTo(backup)
+	require.NoError(t, err)
+	restored := openTest(t, backup, opts)
+	defer restored.Close()
+	require.NoError(t, restored.Set("k", bytes.Repeat([]byte("D"), 64)))
+	paths, err := filepath.Glob(filepath.Join(backup, "*"+valueLogExt))
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(backup, valueLogName(2))}, paths)
+}
+
+func TestValueLogReusedID(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.ValueThreshold = 16
+	d := openTest(t, dir, opts)
+	full := filepath.Join(t.TempDir(), "full")
+	since, err := d.BackupTo(full)
+	require.NoError(t, err)
+	require.NoError(t, d.Set("k", bytes.Repeat([]byte("A"), 64)))
+	lsn := d.LSN()
+	require.NoError(t, d.Close())
+
+	d = openTest(t, dir, opts)
+	require.NoError(t, d.Set("k", []byte("small")))
+	require.NoError(t, d.CollectValueLogs())
+	require.NoError(t, d.Close())
+	_, err = os.Stat(filepath.Join(dir, valueLogName(0)))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// A store written before the id was kept hands out the id again, and
+	// the record of A points to the place of C.
+	require.NoError(t, os.Remove(filepath.Join(dir, valueLogIDFile)))
+	d = openTest(t, dir, opts)
+	defer d.Close()
+	require.NoError(t, d.Set("k", bytes.Repeat([]byte("C"), 64)))
+	_, err = os.Stat(filepath.Join(dir, valueLogName(0)))
+	require.NoError(t, err)
+
+	recovered := recoverTest(t, d, PointInTime{LSN: lsn})
+	requireValues(t, recovered, map[string]string{})
+	require.NoError(t, recovered.Close())
+
+	incremental := filepath.Join(t.TempDir(), "incremental.tar")
+	f, err := os.Create(incremental)
+	require.NoError(t, err)
+	_, err = d.BackupSince(f, since)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, Restore(incremental, full))
+	restored := openTest(t, full, opts)
+	defer restored.Close()
+	recovered = recoverTest(t, restored, PointInTime{LSN: lsn})
+	defer recovered.Close()
+	value, err := recovered.Get("k")
+	if err == nil {
+		require.NotContains(t, string(value), "C")
+	}
+}
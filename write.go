@@ -0,0 +1,430 @@
+// Copyright Pham Vinh Dat
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package daklak
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"time"
+
+	"github.com/phamvinhdat/daklak/record"
+)
+
+// SyncMode decides when appended records are flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncAlways syncs the active segment before a write returns.
+	SyncAlways SyncMode = iota
+	// SyncInterval syncs the active segment every Options.SyncInterval, a
+	// crash can lose the writes of the last interval.
+	SyncInterval
+	// SyncNone leaves flushing to the operating system.
+	SyncNone
+)
+
+// op is a record waiting to be written, along with what it does to the
+// index once it is.
+type op struct {
+	key string
+	r   *record.Record
+	// b is r as written, see encode.
+	b         []byte
+	expiresAt int64
+	tombstone bool
+
+	// lsn is given out when the op is written, unless it is set already.
+	lsn uint64
+
+	// value is where the value of a put was written when it is kept in a
+	// value log.
+	value *record.ValuePointer
+
+	// expire is set for records that only change the expiry of their key.
+	expire bool
+
+	// marker is set for the commit record of a batch, which does not touch
+	// the index. It shares the LSN of the last record of the batch.
+	marker bool
+}
+
+func newPut(r *record.Record) op {
+	o := op{
+		key:   r.Key,
+		r:     r,
+		value: r.Pointer,
+	}
+
+	if r.ExpiatedAt != nil {
+		o.expiresAt = r.ExpiatedAt.UnixMilli()
+	}
+
+	return o
+}
+
+func newDelete(key string) op {
+	return op{
+		key:       key,
+		r:         record.NewDelete(key),
+		tombstone: true,
+	}
+}
+
+func newExpire(key string, at *time.Time) op {
+	o := op{
+		key:    key,
+		r:      record.NewExpire(key, at),
+		expire: true,
+	}
+
+	if at != nil {
+		o.expiresAt = at.UnixMilli()
+	}
+
+	return o
+}
+
+// writeRequest is a set of ops committed together.
+type writeRequest struct {
+	ops  []op
+	err  error
+	done bool
+}
+
+// commit writes ops and applies them to the index. Writers that queue up
+// behind d.mu are committed as a group: whoever gets the lock first writes
+// every pending request with a single write and a single sync, and the
+// others find their request done when they get the lock.
+func (d *Daklak) commit(ops ...op) error {
+	if err := d.check(ops); err != nil {
+		return err
+	}
+
+	if err := d.encode(ops); err != nil {
+		return err
+	}
+
+	req := &writeRequest{ops: ops}
+	d.pendingMu.Lock()
+	d.pending = append(d.pending, req)
+	d.pendingMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if req.done {
+		if req.err != nil {
+			d.discardValues(ops)
+		}
+
+		return req.err
+	}
+
+	d.pendingMu.Lock()
+	group := d.pending
+	d.pending = nil
+	d.pendingMu.Unlock()
+
+	err := d.writeGroup(group)
+	for _, r := range group {
+		r.err = err
+		r.done = true
+	}
+
+	if err != nil {
+		d.discardValues(ops)
+	}
+
+	return req.err
+}
+
+// check rejects writes the store does not take.
+func (d *Daklak) check(ops []op) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	for _, o := range ops {
+		if o.marker {
+			continue
+		}
+
+		if d.opts.MaxKeySize > 0 && len(o.key) > d.opts.MaxKeySize {
+			return fmt.Errorf("%w: key of %d bytes, the limit is %d", ErrKeyTooLarge, len(o.key), d.opts.MaxKeySize)
+		}
+
+		if d.opts.MaxValueSize > 0 && len(o.r.Value) > d.opts.MaxValueSize {
+			return fmt.Errorf("%w: value of %d bytes, the limit is %d", ErrValueTooLarge, len(o.r.Value), d.opts.MaxValueSize)
+		}
+	}
+
+	return nil
+}
+
+// encode marshals the records of the ops that are not marshalled yet. Values
+// of at least Options.ValueThreshold are written to the value log first and
+// their records only hold a pointer to them.
+func (d *Daklak) encode(ops []op) error {
+	for i := range ops {
+		if ops[i].b != nil || ops[i].marker {
+			continue
+		}
+
+		if d.separate(ops[i]) {
+			// The LSN is only given out in stamp, the value gets one that is
+			// not above it.
+			p, err := d.writeValue(ops[i].r, d.lastLSN.Load()+1)
+			if err != nil {
+				d.discardValues(ops[:i])
+				return err
+			}
+
+			r := *ops[i].r
+			r.Value = nil
+			r.Pointer = p
+			ops[i].r = &r
+			ops[i].value = p
+		}
+
+		b, err := ops[i].r.MarshalWith(d.opts.Compression, d.opts.KeyProvider)
+		if err != nil {
+			d.discardValues(ops[:i+1])
+			return err
+		}
+
+		ops[i].b = b
+	}
+
+	return nil
+}
+
+// writeGroup appends the ops of group to the active segment and applies them
+// to the index. The caller must hold d.mu.
+func (d *Daklak) writeGroup(group []*writeRequest) error {
+	var size int
+	for _, req := range group {
+		if err := d.stamp(req.ops); err != nil {
+			return err
+		}
+
+		for _, o := range req.ops {
+			size += len(o.b)
+		}
+	}
+
+	if !d.active.empty() && d.active.size+int64(size) > d.opts.SegmentSize {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+
+	b := make([]byte, 0, size)
+	for _, req := range group {
+		for _, o := range req.ops {
+			b = append(b, o.b...)
+		}
+	}
+
+	offset := d.active.size
+	if _, err := d.active.write(b); err != nil {
+		// Do not leave a partial group for later writes to append to.
+		if truncErr := d.active.truncate(offset); truncErr != nil {
+			d.logf("daklak: truncate %s after failed write: %v", d.active.path, truncErr)
+		}
+
+		return err
+	}
+
+	if d.opts.SyncMode == SyncAlways || (d.opts.SyncMode == SyncInterval && hasBatch(group)) {
+		// The values must be on disk before the pointers to them.
+		if hasValues(group) {
+			if err := d.syncValueLog(); err != nil {
+				return err
+			}
+		}
+
+		if err := d.active.sync(); err != nil {
+			return err
+		}
+	}
+
+	for _, req := range group {
+		for _, o := range req.ops {
+			e := entry{
+				segment:   d.active.id,
+				offset:    offset,
+				size:      int64(len(o.b)),
+				expiresAt: o.expiresAt,
+				value:     o.value,
+				lsn:       o.lsn,
+			}
+			offset += e.size
+			d.apply(o, e)
+		}
+	}
+
+	return nil
+}
+
+// stamp gives the ops their LSNs, in the order they are written, and the
+// time of the write, and encodes the commit record of a batch, whose
+// checksum covers the records of the batch as stamped. The caller must hold
+// d.mu.
+func (d *Daklak) stamp(ops []op) error {
+	now := time.Now()
+	for i := range ops {
+		o := &ops[i]
+		if o.marker {
+			count, _, _ := o.r.BatchCommit()
+			checksum := uint32(0)
+			for _, prev := range ops[i-int(count) : i] {
+				checksum = crc32.Update(checksum, crcTable, prev.b)
+			}
+
+			o.lsn = d.lsn
+			o.r = record.NewBatchCommit(count, checksum)
+			o.r.LSN, o.r.WrittenAt = o.lsn, now
+			b, err := o.r.MarshalWith(d.opts.Compression, d.opts.KeyProvider)
+			if err != nil {
+				return err
+			}
+
+			o.b = b
+			continue
+		}
+
+		if o.lsn == 0 {
+			d.lsn++
+			d.lastLSN.Store(d.lsn)
+			o.lsn = d.lsn
+		}
+
+		if err := record.Stamp(o.b, o.lsn, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasBatch(group []*writeRequest) bool {
+	for _, req := range group {
+		if req.ops[len(req.ops)-1].marker {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasValues(group []*writeRequest) bool {
+	for _, req := range group {
+		for _, o := range req.ops {
+			if o.value != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// apply updates the index for an op written at e.
+func (d *Daklak) apply(o op, e entry) {
+	if o.marker {
+		d.reclaimable.Add(e.size)
+		return
+	}
+
+	if o.expire {
+		if cur, ok := d.keys.Get(o.key); ok {
+			cur.expiresAt = o.expiresAt
+			cur.lsn = o.lsn
+			d.keys.Put(o.key, cur)
+			d.expiries.set(o.key, o.expiresAt)
+		}
+
+		d.reclaimable.Add(e.size)
+		return
+	}
+
+	if o.tombstone {
+		if old, loaded := d.keys.Delete(o.key); loaded {
+			d.release(old)
+		}
+
+		d.expiries.remove(o.key)
+		d.reclaimable.Add(e.size)
+		return
+	}
+
+	if old, loaded := d.keys.Put(o.key, e); loaded {
+		d.release(old)
+	}
+
+	d.expiries.set(o.key, o.expiresAt)
+}
+
+// release counts the record at e, which the index no longer points at, as
+// reclaimable, along with its value if it is in a value log.
+func (d *Daklak) release(e entry) {
+	d.reclaimable.Add(e.size)
+	if e.value != nil {
+		d.segMu.RLock()
+		d.releaseValue(*e.value)
+		d.segMu.RUnlock()
+	}
+}
+
+// syncLoop syncs the active segment every Options.SyncInterval. The sync runs
+// outside d.mu so writers are not held up by it.
+func (d *Daklak) syncLoop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		// Values go first, the segment may already point at them.
+		if err := d.syncValueLog(); err != nil {
+			d.logf("daklak: sync failed: %v", err)
+		}
+
+		d.mu.Lock()
+		active := d.active
+		writer := active.writer
+		d.mu.Unlock()
+
+		// A segment rotated away in the meantime was synced when sealed.
+		switch err := writer.Sync(); {
+		case err == nil:
+			active.syncs.Add(1)
+		case !errors.Is(err, os.ErrClosed):
+			d.logf("daklak: sync failed: %v", err)
+		}
+	}
+}